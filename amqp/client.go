@@ -2,6 +2,7 @@ package amqp
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	amqp "github.com/rabbitmq/amqp091-go"
 	"go.uber.org/zap"
@@ -13,7 +14,8 @@ import (
 type Table amqp.Table
 
 type Client struct {
-	addr string
+	addr     string
+	addrFunc func() (string, error)
 
 	logger *zap.Logger
 
@@ -22,6 +24,9 @@ type Client struct {
 
 	chPool *Pool[confirmChannel]
 
+	observer  Observer
+	connected atomic.Bool
+
 	closed int32
 }
 
@@ -38,7 +43,7 @@ func (c *Client) Close() error {
 	return c.conn.Close()
 }
 
-func Dial(url string, logger *zap.Logger) (*Client, error) {
+func Dial(url string, logger *zap.Logger, options ...ClientOption) (*Client, error) {
 	conn, err := amqp.Dial(url)
 	if err != nil {
 		return nil, err
@@ -53,6 +58,11 @@ func Dial(url string, logger *zap.Logger) (*Client, error) {
 
 		conn: conn,
 	}
+	c.connected.Store(true)
+
+	for _, option := range options {
+		option(c)
+	}
 
 	go c.handleReconnect(url)
 
@@ -62,6 +72,7 @@ func Dial(url string, logger *zap.Logger) (*Client, error) {
 func (c *Client) handleReconnect(url string) {
 	for {
 		reason, ok := <-c.conn.NotifyClose(make(chan *amqp.Error))
+		c.connected.Store(false)
 		c.logger.Debug("rabbitmq connection closed", zap.NamedError("reason", reason))
 		if !ok {
 			break
@@ -78,20 +89,53 @@ func (c *Client) handleReconnect(url string) {
 				return
 			}
 
-			conn, err := amqp.Dial(url)
+			addr := url
+			if c.addrFunc != nil {
+				var err error
+				addr, err = c.addrFunc()
+				if err != nil {
+					c.logger.Error("failed to resolve rabbitmq address", zap.Error(err))
+					continue
+				}
+			}
+
+			conn, err := amqp.Dial(addr)
 			if err != nil {
 				c.logger.Debug("rabbitmq reconnect failed", zap.Error(err))
 				continue
 			}
 
 			c.conn = conn
+			c.connected.Store(true)
 			c.logger.Debug("rabbitmq reconnect success")
 			c.mu.Unlock()
+
+			if c.observer != nil {
+				c.observer.Reconnected()
+			}
 			break
 		}
 	}
 }
 
+// Connected reports whether the connection is open, it's false while reconnecting
+func (c *Client) Connected() bool {
+	return c.connected.Load() && !c.isClosed()
+}
+
+// IdleChannels returns the number of publishing channels in the pool
+func (c *Client) IdleChannels() int {
+	return c.chPool.Len()
+}
+
+// channel opens a new channel, waiting for a reconnect in progress
+func (c *Client) channel() (*amqp.Channel, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.conn.Channel()
+}
+
 func (c *Client) getChannel() (*confirmChannel, error) {
 	var ch *confirmChannel
 	for {
@@ -120,6 +164,14 @@ func (c *Client) getChannel() (*confirmChannel, error) {
 
 	// TODO: confirmations should be configurable
 	confirms := amqpCh.NotifyPublish(make(chan amqp.Confirmation, 1))
+	if c.observer != nil {
+		returns := amqpCh.NotifyReturn(make(chan amqp.Return, 1))
+		go func() {
+			for r := range returns {
+				c.observer.Returned(r.Exchange, r.RoutingKey)
+			}
+		}()
+	}
 	err = amqpCh.Confirm(false)
 	if err != nil {
 		return nil, fmt.Errorf("failed to select confirm: %w", err)
@@ -139,31 +191,91 @@ func (c *Client) returnChannel(ch *confirmChannel) {
 	c.chPool.Push(ch)
 }
 
-func (c *Client) Consume(queue, consumer string, autoAck, exclusive, noLocal, noWait bool, args Table, prefetch int) (<-chan Delivery, error) {
+// NewConsumer creates a consumer, call Consume on it to start consuming
+func (c *Client) NewConsumer(queue, consumer string, autoAck, exclusive, noLocal, noWait bool, args Table, prefetch int, options ...ConsumeOption) *Consumer {
+	if consumer == "" {
+		consumer = consumerTag()
+	}
+
 	con := c.newConsumer(queue, consumer, autoAck, exclusive, noLocal, noWait, args, prefetch)
+	for _, option := range options {
+		option(con)
+	}
+
+	return con
+}
 
-	d, err := con.Consume()
+func (c *Client) Consume(queue, consumer string, autoAck, exclusive, noLocal, noWait bool, args Table, prefetch int, options ...ConsumeOption) (*Consumer, error) {
+	con := c.NewConsumer(queue, consumer, autoAck, exclusive, noLocal, noWait, args, prefetch, options...)
+
+	err := con.Consume()
 	if err != nil {
 		return nil, fmt.Errorf("failed to consume: %w", err)
 	}
 
-	return d, nil
+	return con, nil
+}
+
+func (c *Client) Publish(exchange, key string, mandatory, immediate bool, contentType, contentEncoding string, message []byte, headers Table) error {
+	publishing := amqp.Publishing{
+		Headers:         amqp.Table(headers),
+		ContentType:     contentType,
+		ContentEncoding: contentEncoding,
+		Body:            message,
+		DeliveryMode:    amqp.Persistent,
+	}
+
+	return c.publish(exchange, key, mandatory, immediate, publishing)
+}
+
+// Republish publishes a copy of the delivery with its original properties, extra headers are merged into the copy.
+func (c *Client) Republish(exchange, key string, delivery *Delivery, headers Table) error {
+	merged := make(amqp.Table, len(delivery.Headers)+len(headers))
+	for k, v := range delivery.Headers {
+		merged[k] = v
+	}
+	for k, v := range headers {
+		merged[k] = v
+	}
+
+	publishing := amqp.Publishing{
+		Headers:         merged,
+		ContentType:     delivery.ContentType,
+		ContentEncoding: delivery.ContentEncoding,
+		DeliveryMode:    delivery.DeliveryMode,
+		Priority:        delivery.Priority,
+		CorrelationId:   delivery.CorrelationId,
+		ReplyTo:         delivery.ReplyTo,
+		Expiration:      delivery.Expiration,
+		MessageId:       delivery.MessageId,
+		Timestamp:       delivery.Timestamp,
+		Type:            delivery.Type,
+		AppId:           delivery.AppId,
+		Body:            delivery.Body,
+	}
+
+	return c.publish(exchange, key, false, false, publishing)
 }
 
-func (c *Client) Publish(exchange, key string, mandatory, immediate bool, contentType string, message []byte, headers Table) error {
+// Reply publishes the body to the reply_to queue of the delivery, with its correlation id
+func (c *Client) Reply(delivery *Delivery, body []byte, headers Table) error {
+	publishing := amqp.Publishing{
+		Headers:       amqp.Table(headers),
+		CorrelationId: delivery.CorrelationId,
+		DeliveryMode:  delivery.DeliveryMode,
+		Body:          body,
+	}
+
+	return c.publish("", delivery.ReplyTo, false, false, publishing)
+}
+
+func (c *Client) publish(exchange, key string, mandatory, immediate bool, publishing amqp.Publishing) error {
 	ch, err := c.getChannel()
 	if err != nil {
 		return fmt.Errorf("failed to open channel: %w", err)
 	}
 	defer c.returnChannel(ch)
 
-	publishing := amqp.Publishing{
-		Headers:      amqp.Table(headers),
-		ContentType:  contentType,
-		Body:         message,
-		DeliveryMode: amqp.Persistent,
-	}
-
 	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
 	defer cancel()
 
@@ -176,22 +288,30 @@ func (c *Client) Publish(exchange, key string, mandatory, immediate bool, conten
 		publishing,
 	)
 	if err != nil {
-		return fmt.Errorf("publish failed: %w", err)
+		err = fmt.Errorf("publish failed: %w", err)
+		if c.observer != nil {
+			c.observer.Published(exchange, 0, err)
+		}
+		return err
 	}
 
+	start := time.Now()
 	select {
 	case confirmed, ok := <-ch.Confirms():
 		if !ok {
-			return fmt.Errorf("confirm channel closed")
-		}
-		if !confirmed.Ack {
-			return fmt.Errorf("message was not acked")
+			err = fmt.Errorf("confirm channel closed")
+		} else if !confirmed.Ack {
+			err = fmt.Errorf("message was not acked")
 		}
 	case <-ctx.Done():
-		return fmt.Errorf("publish timeout")
+		err = fmt.Errorf("publish timeout")
+	}
+
+	if c.observer != nil {
+		c.observer.Published(exchange, time.Since(start), err)
 	}
 
-	return nil
+	return err
 }
 
 func (c *Client) DeclareExchange(name, kind string, durable, autoDelete, internal, noWait bool, args Table) error {
@@ -215,6 +335,17 @@ func (c *Client) DeclareQueue(name string, durable, autoDelete, exclusive, noWai
 	return err
 }
 
+// inspectQueue returns the number of ready messages and consumers of the queue
+func (c *Client) inspectQueue(name string) (amqp.Queue, error) {
+	ch, err := c.getChannel()
+	if err != nil {
+		return amqp.Queue{}, fmt.Errorf("failed to open channel: %w", err)
+	}
+	defer c.returnChannel(ch)
+
+	return ch.ch.QueueDeclarePassive(name, false, false, false, false, nil)
+}
+
 func (c *Client) BindQueue(queue, exchange, key string, noWait bool, args Table) error {
 	ch, err := c.getChannel()
 	if err != nil {
@@ -224,3 +355,29 @@ func (c *Client) BindQueue(queue, exchange, key string, noWait bool, args Table)
 
 	return ch.ch.QueueBind(queue, key, exchange, noWait, amqp.Table(args))
 }
+
+// Replace fetches a single message from the queue and replaces it with the message returned by fn.
+// The replacement is published before the fetched message is acked, so the queue is never left without a message,
+// when fn or the publish fails, the fetched message is requeued instead.
+func (c *Client) Replace(queue string, fn func(body []byte) ([]byte, error)) ([]byte, bool, error) {
+	ch, err := c.getChannel()
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to open channel: %w", err)
+	}
+	defer c.returnChannel(ch)
+
+	d, ok, err := ch.ch.Get(queue, false)
+	if err != nil || !ok {
+		return nil, ok, err
+	}
+
+	replacement, err := fn(d.Body)
+	if err == nil {
+		err = c.Publish("", queue, false, false, d.ContentType, d.ContentEncoding, replacement, nil)
+	}
+	if err != nil {
+		return nil, false, errors.Join(err, d.Nack(false, true))
+	}
+
+	return d.Body, true, d.Ack(false)
+}
@@ -1,15 +1,18 @@
 package amqp
 
 import (
+	"context"
 	"fmt"
 	amqp "github.com/rabbitmq/amqp091-go"
 	"go.uber.org/zap"
+	"os"
+	"strconv"
 	"sync"
 	"sync/atomic"
 	"time"
 )
 
-type consumer struct {
+type Consumer struct {
 	client *Client
 	logger *zap.Logger
 
@@ -22,15 +25,87 @@ type consumer struct {
 	args        Table
 	prefetch    int
 
+	// argsFn overrides args, it's called on every (re)dial and resume
+	argsFn func(resumed bool) Table
+
 	ch *amqp.Channel
 	mu sync.Mutex
 
+	deliveries chan Delivery
+	// wg tracks forward goroutines, deliveries are closed once all of them exit
+	wg sync.WaitGroup
+	// consumeDone is closed when the current forward goroutine exits
+	consumeDone chan struct{}
+	delivered   atomic.Uint64
+	channelOpen atomic.Bool
+
+	paused bool
+
+	// singleActive consumers probe the queue to find out whether they are active,
+	// on single active consumer queues only the active consumer receives deliveries
+	singleActive bool
+	state        ConsumerState
+	stateSince   time.Time
+	onState      func(state ConsumerState)
+	stateMu      sync.Mutex
+
 	// TODO: reevaluate if this is needed
 	closed int32
 }
 
-func (c *Client) newConsumer(queue, consumerTag string, autoAck, exclusive, noLocal, noWait bool, args Table, prefetch int) *consumer {
-	return &consumer{
+type ConsumerState int32
+
+const (
+	// StateUnknown is the state until the broker state shows whether the consumer is active
+	StateUnknown ConsumerState = iota
+	StateActive
+	// StateStandby consumers don't receive deliveries while another consumer of the single active consumer queue is active
+	StateStandby
+)
+
+// standbyProbeInterval is how often the queue is checked while the consumer isn't active
+const standbyProbeInterval = 5 * time.Second
+
+type ConsumeOption func(c *Consumer)
+
+// WithStateNotify registers a callback called when the consumer state changes
+func WithStateNotify(fn func(state ConsumerState)) ConsumeOption {
+	return func(c *Consumer) {
+		c.onState = fn
+	}
+}
+
+// WithSingleActive marks consumers of single active consumer queues, they aren't active until the broker state shows it
+func WithSingleActive(singleActive bool) ConsumeOption {
+	return func(c *Consumer) {
+		c.singleActive = singleActive
+	}
+}
+
+// WithArgsFunc computes the consume arguments on every (re)dial, e.g. to resume a stream from the last offset.
+// resumed is set when the consumer resumes after a pause on the same channel, its deliveries can still be acked then.
+func WithArgsFunc(fn func(resumed bool) Table) ConsumeOption {
+	return func(c *Consumer) {
+		c.argsFn = fn
+	}
+}
+
+var consumerSeq uint64
+
+// consumerTag generates a tag in the format used by amqp091-go for consumers without a tag,
+// it's generated here, so the consumer can be cancelled with it
+func consumerTag() string {
+	seq := strconv.FormatUint(atomic.AddUint64(&consumerSeq, 1), 10)
+	tag := "ctag-" + os.Args[0] + "-" + seq
+	if len(tag) > 255 {
+		tag = "ctag-streadway/amqp-" + seq
+	}
+
+	return tag
+}
+
+func (c *Client) newConsumer(queue, consumerTag string, autoAck, exclusive, noLocal, noWait bool, args Table, prefetch int) *Consumer {
+	return &Consumer{
 		client: c,
 		logger: c.logger,
 
@@ -45,11 +120,11 @@ func (c *Client) newConsumer(queue, consumerTag string, autoAck, exclusive, noLo
 	}
 }
 
-func (c *consumer) isClosed() bool {
+func (c *Consumer) isClosed() bool {
 	return atomic.LoadInt32(&c.closed) == 1 || c.client.isClosed()
 }
 
-func (c *consumer) Close() error {
+func (c *Consumer) Close() error {
 	atomic.StoreInt32(&c.closed, 1)
 
 	c.mu.Lock()
@@ -65,26 +140,204 @@ func (c *consumer) Close() error {
 	return nil
 }
 
-func (c *consumer) Consume() (<-chan Delivery, error) {
-	out := make(chan Delivery)
+// Tag returns the consumer tag
+func (c *Consumer) Tag() string {
+	return c.consumerTag
+}
+
+func (c *Consumer) Queue() string {
+	return c.queue
+}
+
+// Deliveries returns the channel of deliveries, it's closed when the consumer is closed
+func (c *Consumer) Deliveries() <-chan Delivery {
+	return c.deliveries
+}
+
+// State returns the consumer state and since when it's in it
+func (c *Consumer) State() (ConsumerState, time.Time) {
+	c.stateMu.Lock()
+	defer c.stateMu.Unlock()
+
+	return c.state, c.stateSince
+}
+
+func (c *Consumer) setState(state ConsumerState) {
+	c.stateMu.Lock()
+	if c.state == state {
+		c.stateMu.Unlock()
+		return
+	}
+	c.state = state
+	c.stateSince = time.Now()
+	c.stateMu.Unlock()
+
+	if c.onState != nil {
+		c.onState(state)
+	}
+}
+
+// probe checks the queue until the consumer is active or stops consuming.
+// A delivery shows the consumer is active. The only consumer of the queue is active too, even with the queue empty.
+// With other consumers, ready messages the consumer doesn't receive show another consumer is active.
+// With other consumers and an empty queue, the state stays as it is.
+func (c *Consumer) probe(done chan struct{}, delivered uint64) {
+	ticker := time.NewTicker(standbyProbeInterval)
+	defer ticker.Stop()
+
+	for {
+		if state, _ := c.State(); state == StateActive {
+			return
+		}
+
+		queue, err := c.client.inspectQueue(c.queue)
+		if err != nil {
+			c.logger.Debug("failed to inspect queue", zap.String("queue", c.queue), zap.Error(err))
+		} else {
+			switch {
+			case queue.Consumers == 1:
+				c.setState(StateActive)
+				return
+			case queue.Messages > 0 && c.delivered.Load() == delivered:
+				c.setState(StateStandby)
+			}
+		}
+
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (c *Consumer) Consume() error {
+	c.deliveries = make(chan Delivery)
 
-	in, err := c.dial()
+	closeCh, err := c.dial()
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	go c.consume(in, out)
-	go c.redial(out)
+	go c.redial(c.deliveries, closeCh)
 
-	return out, nil
+	return nil
 }
 
-func (c *consumer) dial() (<-chan amqp.Delivery, error) {
+// Pause cancels the consumer on the broker, deliveries already received are still forwarded.
+// The channel is kept open, so the received deliveries can be acked.
+func (c *Consumer) Pause() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.paused {
+		return nil
+	}
+	c.paused = true
+
+	// the consumer is not recreated on redial while paused
+	if c.ch == nil || c.ch.IsClosed() {
+		return nil
+	}
+
+	err := c.ch.Cancel(c.consumerTag, false)
+	if err != nil {
+		return fmt.Errorf("failed to cancel consumer: %w", err)
+	}
+	// a cancelled consumer hands the leadership of single active consumer queues over
+	c.setState(StateUnknown)
+
+	return nil
+}
+
+func (c *Consumer) Resume() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if !c.paused {
+		return nil
+	}
+	c.paused = false
+
+	// the consumer is recreated on redial
+	if c.isClosed() || c.ch == nil || c.ch.IsClosed() {
+		return nil
+	}
+
+	// the deliveries received before the pause are forwarded first, so the consumer resumes after them
+	done := c.consumeDone
+	if done != nil {
+		c.mu.Unlock()
+		<-done
+		c.mu.Lock()
+
+		// paused again, closed or recreated on redial meanwhile
+		if c.paused || c.consumeDone != done || c.isClosed() || c.ch.IsClosed() {
+			return nil
+		}
+	}
+
+	return c.consume(true)
+}
+
+func (c *Consumer) Paused() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.paused
+}
+
+// WaitCancelled waits until all deliveries received before the consumer was cancelled are forwarded
+func (c *Consumer) WaitCancelled(ctx context.Context) error {
+	c.mu.Lock()
+	done := c.consumeDone
+	c.mu.Unlock()
+
+	if done == nil {
+		return nil
+	}
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Forwarding reports whether deliveries are being received and forwarded
+func (c *Consumer) Forwarding() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.consumeDone == nil {
+		return false
+	}
+
+	select {
+	case <-c.consumeDone:
+		return false
+	default:
+		return true
+	}
+}
+
+// ChannelOpen reports whether the consumer channel is open
+func (c *Consumer) ChannelOpen() bool {
+	return c.channelOpen.Load()
+}
+
+// Delivered returns the number of deliveries forwarded so far
+func (c *Consumer) Delivered() uint64 {
+	return c.delivered.Load()
+}
+
+func (c *Consumer) dial() (chan *amqp.Error, error) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
 	var err error
-	c.ch, err = c.client.conn.Channel()
+	c.ch, err = c.client.channel()
 	if err == nil && c.prefetch != 0 {
 		err = c.ch.Qos(c.prefetch, 0, false)
 	}
@@ -92,52 +345,96 @@ func (c *consumer) dial() (<-chan amqp.Delivery, error) {
 		return nil, fmt.Errorf("failed to open channel: %w", err)
 	}
 
-	d, err := c.ch.Consume(c.queue, c.consumerTag, c.autoAck, c.exclusive, c.noLocal, c.noWait, amqp.Table(c.args))
+	// registered before consuming, so a channel closed right away is not missed
+	closeCh := c.ch.NotifyClose(make(chan *amqp.Error, 1))
+	c.channelOpen.Store(true)
+
+	if c.paused {
+		return closeCh, nil
+	}
+
+	err = c.consume(false)
 	if err != nil {
-		return nil, fmt.Errorf("failed to consume: %w", err)
+		c.channelOpen.Store(false)
+		_ = c.ch.Close()
+		return nil, err
 	}
 
-	return d, nil
+	return closeCh, nil
 }
 
-func (c *consumer) consume(in <-chan amqp.Delivery, out chan<- Delivery) {
+// consume starts consuming on the current channel, c.mu must be held
+func (c *Consumer) consume(resumed bool) error {
+	args := c.args
+	if c.argsFn != nil {
+		args = c.argsFn(resumed)
+	}
+
+	in, err := c.ch.Consume(c.queue, c.consumerTag, c.autoAck, c.exclusive, c.noLocal, c.noWait, amqp.Table(args))
+	if err != nil {
+		return fmt.Errorf("failed to consume: %w", err)
+	}
+
+	c.consumeDone = make(chan struct{})
+	c.wg.Add(1)
+	go c.forward(in, c.deliveries, c.consumeDone)
+
+	if c.singleActive {
+		go c.probe(c.consumeDone, c.delivered.Load())
+	} else {
+		c.setState(StateActive)
+	}
+
+	return nil
+}
+
+func (c *Consumer) forward(in <-chan amqp.Delivery, out chan<- Delivery, done chan struct{}) {
+	defer c.wg.Done()
+	defer close(done)
+
 	for msg := range in {
+		c.setState(StateActive)
+		c.delivered.Add(1)
 		out <- Delivery{msg}
 	}
 	c.logger.Debug("rabbitmq consume channel closed")
 }
 
-// TODO: add logging
-func (c *consumer) redial(out chan Delivery) {
-	defer close(out)
-
-	var err error
-	var in <-chan amqp.Delivery
+func (c *Consumer) redial(out chan Delivery, closeCh chan *amqp.Error) {
+	defer func() {
+		c.wg.Wait()
+		close(out)
+	}()
 
 	for {
-		closeCh := make(chan *amqp.Error, 1)
-		c.ch.NotifyClose(closeCh)
-
 		// nolint:staticcheck // SA4023 err is null when channel is gracefully closed
-		err = <-closeCh
+		reason := <-closeCh
+		c.channelOpen.Store(false)
+		c.setState(StateUnknown)
 		// nolint:staticcheck
-		if err == nil {
+		if reason == nil || c.isClosed() {
 			return
 		}
 
-		in, err = c.dial()
-		if err != nil {
-			return
-		}
+		c.logger.Debug("rabbitmq consumer channel closed", zap.String("queue", c.queue), zap.NamedError("reason", reason))
 
-		go c.consume(in, out)
+		for {
+			// TODO: configurable reconnect interval, and consider progressive backoff
+			time.Sleep(3 * time.Second)
 
-		if c.isClosed() {
+			if c.isClosed() {
+				return
+			}
+
+			var err error
+			closeCh, err = c.dial()
+			if err != nil {
+				c.logger.Debug("rabbitmq consumer redial failed", zap.String("queue", c.queue), zap.Error(err))
+				continue
+			}
+
+			c.logger.Debug("rabbitmq consumer redial success", zap.String("queue", c.queue))
 			break
 		}
-
-		go c.ch.Close()
-		// TODO: configurable reconnect interval, and consider progressive backoff
-		time.Sleep(3 * time.Second)
 	}
 }
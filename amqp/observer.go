@@ -0,0 +1,31 @@
+package amqp
+
+import (
+	"time"
+)
+
+// Observer is notified of client events, e.g. to collect metrics
+type Observer interface {
+	// Published is called once a publish is confirmed, err is set when it failed or was nacked
+	Published(exchange string, confirmLatency time.Duration, err error)
+	// Returned is called for unroutable mandatory publishes returned by the broker
+	Returned(exchange, key string)
+	// Reconnected is called once the connection is reestablished
+	Reconnected()
+}
+
+type ClientOption func(c *Client)
+
+// WithObserver registers an observer of the client events
+func WithObserver(observer Observer) ClientOption {
+	return func(c *Client) {
+		c.observer = observer
+	}
+}
+
+// WithAddrFunc resolves the address again on every reconnect, e.g. to pick up rotated credentials
+func WithAddrFunc(addr func() (string, error)) ClientOption {
+	return func(c *Client) {
+		c.addrFunc = addr
+	}
+}
@@ -0,0 +1,321 @@
+package thumper
+
+import (
+	"fmt"
+	"github.com/roadrunner-server/errors"
+	"github.com/roadrunner-server/pool/payload"
+	"go.uber.org/zap"
+	"sync"
+	"time"
+)
+
+// batch is a group of messages processed by a single execution
+type batch struct {
+	messages []*message
+	tracker  *batchTracker
+	id       uint64
+}
+
+// batchTracker tracks the batches of a consumer in flight,
+// a batch can be acked with multiple only when no older batch of the consumer is in flight
+type batchTracker struct {
+	mu          sync.Mutex
+	seq         uint64
+	outstanding []uint64
+}
+
+func (t *batchTracker) add() uint64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.seq++
+	t.outstanding = append(t.outstanding, t.seq)
+
+	return t.seq
+}
+
+func (t *batchTracker) oldest(id uint64) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return len(t.outstanding) > 0 && t.outstanding[0] == id
+}
+
+func (t *batchTracker) done(id uint64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for i, outstanding := range t.outstanding {
+		if outstanding == id {
+			t.outstanding = append(t.outstanding[:i], t.outstanding[i+1:]...)
+			return
+		}
+	}
+}
+
+// batchConsumer groups deliveries into batches of up to batch.size messages,
+// a batch is dispatched once it's full or batch.wait after its first message
+func (w *Worker) batchConsumer(c *consumer, l *lane) {
+	defer w.wg.Done()
+	defer w.sched.closeLane(l)
+
+	var semaphore chan struct{}
+	if c.cfg.Concurrency > 0 {
+		semaphore = make(chan struct{}, c.cfg.Concurrency)
+	}
+
+	tracker := &batchTracker{}
+
+	var pending []*message
+	var timer *time.Timer
+	var timerCh <-chan time.Time
+
+	flush := func() {
+		if timer != nil {
+			timer.Stop()
+			timer, timerCh = nil, nil
+		}
+		if len(pending) == 0 {
+			return
+		}
+
+		msg := &message{
+			consumer: c.cfg,
+			batch: &batch{
+				messages: pending,
+				tracker:  tracker,
+				id:       tracker.add(),
+			},
+		}
+		pending = nil
+
+		w.dispatch(l, msg, semaphore)
+	}
+
+	deliveries := c.amqp.Deliveries()
+	for {
+		select {
+		case delivery, ok := <-deliveries:
+			if !ok {
+				flush()
+				return
+			}
+
+			pending = append(pending, c.message(&delivery))
+			if len(pending) == 1 {
+				timer = time.NewTimer(c.cfg.Batch.Wait)
+				timerCh = timer.C
+			}
+			if len(pending) >= c.cfg.Batch.Size {
+				flush()
+			}
+		case <-timerCh:
+			flush()
+		}
+	}
+}
+
+func (w *Worker) doBatch(msg *message) {
+	b := msg.batch
+	defer b.tracker.done(b.id)
+
+	if msg.semaphore != nil {
+		defer func() {
+			<-msg.semaphore
+		}()
+	}
+
+	messages := make([]*message, 0, len(b.messages))
+	for _, m := range b.messages {
+		if m.finished != nil {
+			defer m.finished()
+		}
+
+		if m.delivery.Acknowledger.(interface {
+			IsClosed() bool
+		}).IsClosed() {
+			continue
+		}
+
+		defer m.settled()
+		messages = append(messages, m)
+	}
+
+	if len(messages) == 0 {
+		return
+	}
+
+	ctx, span := startBatchSpan(messages, msg.consumer.Queue)
+	defer span.End()
+	for _, m := range messages {
+		m.span, m.batched = span, true
+	}
+
+	w.execMu.RLock()
+	defer w.execMu.RUnlock()
+
+	if w.ctx.Err() != nil || w.stopping.Load() {
+		for _, m := range messages {
+			w.requeue(m)
+		}
+		return
+	}
+
+	// messages that can't be decompressed fail on their own
+	decoded := messages[:0]
+	for _, m := range messages {
+		err := w.decodeBody(m)
+		if err != nil {
+			w.workFailed(m, "failed to decompress body", err)
+			continue
+		}
+		decoded = append(decoded, m)
+	}
+	messages = decoded
+
+	if len(messages) == 0 {
+		return
+	}
+
+	pld, err := createBatchPayload(messages, msg.consumer, traceContext(ctx))
+	if err != nil {
+		w.batchFailed(messages, "failed to create payload", err)
+		return
+	}
+
+	start := time.Now()
+	result, err := w.exec(pld, msg.consumer.ExecTimeout, nil)
+	w.metrics.executed(msg.consumer.Queue, time.Since(start))
+	if err != nil {
+		if errors.Is(errors.Stop, err) {
+			w.log.Warn("execution cancelled", zap.Int("batch", len(messages)), zap.Error(err))
+			for _, m := range messages {
+				w.requeue(m)
+			}
+			return
+		}
+		if errors.Is(errors.ExecTTL, err) {
+			w.batchFailed(messages, "execution timeout", err)
+			return
+		}
+		w.batchFailed(messages, "failed to execute payload", err)
+		return
+	}
+
+	if len(result.Body) != len(messages) {
+		w.batchFailed(messages, "malformed response body", errors.Str("malformed response body"))
+		return
+	}
+
+	if msg.consumer.AutoAck {
+		for _, m := range messages {
+			spanSettled(m, outcomeAutoAck)
+		}
+		return
+	}
+
+	// the leading acks of the batch are acked at once, when the batch is the consumer's oldest in flight
+	// nothing else is unacked on the channel below them
+	acked := 0
+	if b.tracker.oldest(b.id) {
+		acknowledger := messages[0].delivery.Acknowledger
+		for acked < len(messages) && result.Body[acked] == Ack && messages[acked].delivery.Acknowledger == acknowledger {
+			acked++
+		}
+
+		if acked > 1 {
+			err = messages[acked-1].delivery.Ack(true)
+			for _, m := range messages[:acked] {
+				spanSettled(m, outcomeAck)
+			}
+			if err != nil {
+				w.log.Error("failed to ack messages", zap.Int("count", acked), zap.Error(err))
+				spanFailed(span, "failed to ack messages", err)
+			} else {
+				w.metrics.settled(msg.consumer.Queue, Ack, acked)
+			}
+		} else {
+			acked = 0
+		}
+	}
+
+	for i := acked; i < len(messages); i++ {
+		delivery := messages[i].delivery
+
+		spanSettled(messages[i], resultOutcome(result.Body[i]))
+		switch result.Body[i] {
+		case Ack:
+			err = delivery.Ack(false)
+		case Nack:
+			err = delivery.Nack(false, true)
+		case Reject:
+			err = delivery.Reject(false)
+		}
+
+		if err != nil {
+			w.log.Error("failed to ack message", zap.Error(err))
+			spanFailed(span, "failed to ack message", err)
+			continue
+		}
+		w.metrics.settled(msg.consumer.Queue, result.Body[i], 1)
+	}
+}
+
+func (w *Worker) batchFailed(messages []*message, logMsg string, err error) {
+	w.log.Error(logMsg, zap.Int("batch", len(messages)), zap.Error(err))
+	if len(messages) > 0 {
+		spanFailed(messages[0].span, logMsg, err)
+	}
+
+	for _, msg := range messages {
+		w.fail(msg, logMsg, err)
+	}
+}
+
+// createBatchPayload encodes the bodies as a list with the consumer codec, the context holds the metadata of each
+func createBatchPayload(messages []*message, consumer *ConsumerConfig, trace map[string]string) (*payload.Payload, error) {
+	codec, err := contextCodec(consumer.Codec)
+	if err != nil {
+		return nil, err
+	}
+
+	bodies := make([][]byte, 0, len(messages))
+	msgContext := &BatchContext{
+		Version:  ContextVersion,
+		Queue:    consumer.Queue,
+		Messages: make([]*BatchMessageContext, 0, len(messages)),
+		Trace:    trace,
+	}
+	for _, msg := range messages {
+		delivery := msg.delivery
+		body := msg.body
+		// empty bodies are encoded as empty strings rather than nulls
+		if body == nil {
+			body = []byte{}
+		}
+		bodies = append(bodies, body)
+		msgContext.Messages = append(msgContext.Messages, &BatchMessageContext{
+			Headers:     delivery.Headers,
+			Exchange:    delivery.Exchange,
+			RoutingKey:  delivery.RoutingKey,
+			DeliveryTag: delivery.DeliveryTag,
+		})
+	}
+
+	body, err := encodeBodies(consumer.Codec, bodies)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode bodies: %w", err)
+	}
+
+	pld := &payload.Payload{
+		Body:  body,
+		Codec: codec,
+	}
+
+	pld.Context, err = encodeContext(consumer.Codec, msgContext)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal message headers: %w", err)
+	}
+
+	return pld, nil
+}
@@ -0,0 +1,107 @@
+package thumper
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/vmihailenco/msgpack/v5"
+	"google.golang.org/protobuf/encoding/protowire"
+	"testing"
+)
+
+func TestCreateBatchPayloadBodies(t *testing.T) {
+	bodies := [][]byte{[]byte(`{"id":1}`), nil, {0x00, 0xff, 0x10}, []byte("plain")}
+
+	decode := map[string]func(body []byte) ([][]byte, error){
+		CodecJSON: func(body []byte) ([][]byte, error) {
+			var decoded [][]byte
+			return decoded, json.Unmarshal(body, &decoded)
+		},
+		CodecMsgpack: func(body []byte) ([][]byte, error) {
+			var decoded [][]byte
+			return decoded, msgpack.Unmarshal(body, &decoded)
+		},
+		CodecProto: func(body []byte) ([][]byte, error) {
+			var decoded [][]byte
+			for len(body) > 0 {
+				num, typ, n := protowire.ConsumeTag(body)
+				if n < 0 {
+					return nil, protowire.ParseError(n)
+				}
+				body = body[n:]
+				if num != 1 || typ != protowire.BytesType {
+					t.Fatalf("unexpected field %d of type %d", num, typ)
+				}
+				value, n := protowire.ConsumeBytes(body)
+				if n < 0 {
+					return nil, protowire.ParseError(n)
+				}
+				body = body[n:]
+				decoded = append(decoded, value)
+			}
+			return decoded, nil
+		},
+	}
+
+	for codec, decode := range decode {
+		t.Run(codec, func(t *testing.T) {
+			messages := make([]*message, 0, len(bodies))
+			for i, body := range bodies {
+				msg := testMessage("m" + string(rune('0'+i)))
+				msg.delivery.DeliveryTag = uint64(i + 1)
+				msg.body = body
+				messages = append(messages, msg)
+			}
+
+			pld, err := createBatchPayload(messages, &ConsumerConfig{Queue: "events", Codec: codec}, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			decoded, err := decode(pld.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if codec == CodecJSON && bytes.Contains(pld.Body, []byte("null")) {
+				t.Errorf("empty body encoded as null: %s", pld.Body)
+			}
+			if len(decoded) != len(bodies) {
+				t.Fatalf("decoded %d bodies, expected %d", len(decoded), len(bodies))
+			}
+			for i := range bodies {
+				if !bytes.Equal(decoded[i], bodies[i]) {
+					t.Errorf("body %d is %q, expected %q", i, decoded[i], bodies[i])
+				}
+			}
+		})
+	}
+}
+
+func TestCreateBatchPayloadContext(t *testing.T) {
+	msg := testMessage("m0")
+	msg.delivery.DeliveryTag = 7
+	msg.delivery.RoutingKey = "events.created"
+	msg.body = []byte("body")
+
+	pld, err := createBatchPayload([]*message{msg}, &ConsumerConfig{Queue: "events"}, map[string]string{"traceparent": "00-01"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var msgContext map[string]any
+	err = json.Unmarshal(pld.Context, &msgContext)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	messages := msgContext["messages"].([]any)
+	if len(messages) != 1 || msgContext["queue"] != "events" || msgContext["trace"].(map[string]any)["traceparent"] != "00-01" {
+		t.Fatalf("unexpected context %v", msgContext)
+	}
+	first := messages[0].(map[string]any)
+	if first["deliveryTag"] != float64(7) || first["routingKey"] != "events.created" {
+		t.Errorf("unexpected message context %v", first)
+	}
+	if _, ok := first["size"]; ok {
+		t.Error("message context still has the body size")
+	}
+}
@@ -0,0 +1,286 @@
+package thumper
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	amqp091 "github.com/rabbitmq/amqp091-go"
+	"github.com/roadrunner-server/goridge/v3/pkg/frame"
+	"github.com/vmihailenco/msgpack/v5"
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/structpb"
+	"time"
+)
+
+// ContextVersion is the version of the context schema, it's bumped on incompatible changes
+const ContextVersion = 1
+
+const (
+	CodecJSON    = "json"
+	CodecMsgpack = "msgpack"
+	CodecProto   = "proto"
+)
+
+// MessageContext is sent to the worker with the message body, see proto/thumper.proto for the protobuf schema
+type MessageContext struct {
+	Version     int            `json:"version" msgpack:"version"`
+	Queue       string         `json:"queue" msgpack:"queue"`
+	Headers     map[string]any `json:"headers" msgpack:"headers"`
+	Exchange    string         `json:"exchange" msgpack:"exchange"`
+	RoutingKey  string         `json:"routingKey" msgpack:"routingKey"`
+	DeliveryTag uint64         `json:"deliveryTag" msgpack:"deliveryTag"`
+	// BodyID is set instead of the payload body for large bodies, the worker reads the body in chunks over RPC
+	BodyID   string `json:"bodyId,omitempty" msgpack:"bodyId,omitempty"`
+	BodySize int    `json:"bodySize,omitempty" msgpack:"bodySize,omitempty"`
+	// Trace holds the W3C trace context headers of the consumer span
+	Trace map[string]string `json:"trace,omitempty" msgpack:"trace,omitempty"`
+}
+
+// BatchContext is sent to the worker with the bodies of a batch, see encodeBodies
+type BatchContext struct {
+	Version  int                    `json:"version" msgpack:"version"`
+	Queue    string                 `json:"queue" msgpack:"queue"`
+	Messages []*BatchMessageContext `json:"messages" msgpack:"messages"`
+	// Trace holds the W3C trace context headers of the batch span
+	Trace map[string]string `json:"trace,omitempty" msgpack:"trace,omitempty"`
+}
+
+type BatchMessageContext struct {
+	Headers     map[string]any `json:"headers" msgpack:"headers"`
+	Exchange    string         `json:"exchange" msgpack:"exchange"`
+	RoutingKey  string         `json:"routingKey" msgpack:"routingKey"`
+	DeliveryTag uint64         `json:"deliveryTag" msgpack:"deliveryTag"`
+}
+
+// contextCodec returns the goridge codec flag of the codec
+func contextCodec(codec string) (byte, error) {
+	switch codec {
+	case "", CodecJSON:
+		return frame.CodecJSON, nil
+	case CodecMsgpack:
+		return frame.CodecMsgpack, nil
+	case CodecProto:
+		return frame.CodecProto, nil
+	default:
+		return 0, fmt.Errorf("unknown codec %s, expected json, msgpack or proto", codec)
+	}
+}
+
+func encodeContext(codec string, msgContext any) ([]byte, error) {
+	switch codec {
+	case "", CodecJSON:
+		return json.Marshal(msgContext)
+	case CodecMsgpack:
+		return msgpack.Marshal(msgContext)
+	case CodecProto:
+		switch msgContext := msgContext.(type) {
+		case *MessageContext:
+			return msgContext.appendProto(nil)
+		case *BatchContext:
+			return msgContext.appendProto(nil)
+		}
+		return nil, fmt.Errorf("unsupported context %T", msgContext)
+	default:
+		return nil, fmt.Errorf("unknown codec %s", codec)
+	}
+}
+
+func (c *MessageContext) appendProto(b []byte) ([]byte, error) {
+	b = protowire.AppendTag(b, 1, protowire.VarintType)
+	b = protowire.AppendVarint(b, uint64(c.Version))
+	b = appendProtoString(b, 2, c.Queue)
+
+	b, err := appendProtoHeaders(b, 3, c.Headers)
+	if err != nil {
+		return nil, err
+	}
+
+	b = appendProtoString(b, 4, c.Exchange)
+	b = appendProtoString(b, 5, c.RoutingKey)
+	b = protowire.AppendTag(b, 6, protowire.VarintType)
+	b = protowire.AppendVarint(b, c.DeliveryTag)
+	b = appendProtoString(b, 7, c.BodyID)
+	b = appendProtoMap(b, 8, c.Trace)
+	if c.BodySize > 0 {
+		b = protowire.AppendTag(b, 9, protowire.VarintType)
+		b = protowire.AppendVarint(b, uint64(c.BodySize))
+	}
+
+	return b, nil
+}
+
+func (c *BatchContext) appendProto(b []byte) ([]byte, error) {
+	b = protowire.AppendTag(b, 1, protowire.VarintType)
+	b = protowire.AppendVarint(b, uint64(c.Version))
+	b = appendProtoString(b, 2, c.Queue)
+
+	for _, message := range c.Messages {
+		encoded, err := message.appendProto(nil)
+		if err != nil {
+			return nil, err
+		}
+		b = protowire.AppendTag(b, 3, protowire.BytesType)
+		b = protowire.AppendBytes(b, encoded)
+	}
+	b = appendProtoMap(b, 4, c.Trace)
+
+	return b, nil
+}
+
+func (c *BatchMessageContext) appendProto(b []byte) ([]byte, error) {
+	b, err := appendProtoHeaders(b, 1, c.Headers)
+	if err != nil {
+		return nil, err
+	}
+
+	b = appendProtoString(b, 2, c.Exchange)
+	b = appendProtoString(b, 3, c.RoutingKey)
+	b = protowire.AppendTag(b, 4, protowire.VarintType)
+	b = protowire.AppendVarint(b, c.DeliveryTag)
+
+	return b, nil
+}
+
+// encodeBodies encodes the bodies of a batch as a list in the order of the context messages:
+// a JSON array of base64 strings, a msgpack array of binaries or the proto BatchBody message
+func encodeBodies(codec string, bodies [][]byte) ([]byte, error) {
+	switch codec {
+	case "", CodecJSON:
+		return json.Marshal(bodies)
+	case CodecMsgpack:
+		return msgpack.Marshal(bodies)
+	case CodecProto:
+		var b []byte
+		for _, body := range bodies {
+			b = protowire.AppendTag(b, 1, protowire.BytesType)
+			b = protowire.AppendBytes(b, body)
+		}
+		return b, nil
+	default:
+		return nil, fmt.Errorf("unknown codec %s", codec)
+	}
+}
+
+func appendProtoString(b []byte, num protowire.Number, value string) []byte {
+	if value == "" {
+		return b
+	}
+
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendString(b, value)
+}
+
+// appendProtoMap encodes a map<string, string> field
+func appendProtoMap(b []byte, num protowire.Number, values map[string]string) []byte {
+	for key, value := range values {
+		var entry []byte
+		entry = appendProtoString(entry, 1, key)
+		entry = appendProtoString(entry, 2, value)
+
+		b = protowire.AppendTag(b, num, protowire.BytesType)
+		b = protowire.AppendBytes(b, entry)
+	}
+
+	return b
+}
+
+// appendProtoHeaders encodes the headers as google.protobuf.Struct, the values are converted as they are for JSON
+func appendProtoHeaders(b []byte, num protowire.Number, headers map[string]any) ([]byte, error) {
+	if len(headers) == 0 {
+		return b, nil
+	}
+
+	headersStruct, err := protoStruct(headers)
+	if err != nil {
+		return nil, err
+	}
+
+	encoded, err := proto.Marshal(headersStruct)
+	if err != nil {
+		return nil, err
+	}
+
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendBytes(b, encoded), nil
+}
+
+func protoStruct(table map[string]any) (*structpb.Struct, error) {
+	fields := make(map[string]*structpb.Value, len(table))
+	for key, value := range table {
+		v, err := protoValue(value)
+		if err != nil {
+			return nil, fmt.Errorf("header %s: %w", key, err)
+		}
+		fields[key] = v
+	}
+
+	return &structpb.Struct{Fields: fields}, nil
+}
+
+// protoValue converts an AMQP table value, byte arrays are base64 encoded, timestamps are RFC 3339 strings
+// and decimals are objects with Scale and Value
+func protoValue(value any) (*structpb.Value, error) {
+	switch value := value.(type) {
+	case nil:
+		return structpb.NewNullValue(), nil
+	case bool:
+		return structpb.NewBoolValue(value), nil
+	case int8:
+		return structpb.NewNumberValue(float64(value)), nil
+	case uint8:
+		return structpb.NewNumberValue(float64(value)), nil
+	case int16:
+		return structpb.NewNumberValue(float64(value)), nil
+	case uint16:
+		return structpb.NewNumberValue(float64(value)), nil
+	case int32:
+		return structpb.NewNumberValue(float64(value)), nil
+	case uint32:
+		return structpb.NewNumberValue(float64(value)), nil
+	case int64:
+		return structpb.NewNumberValue(float64(value)), nil
+	case int:
+		return structpb.NewNumberValue(float64(value)), nil
+	case float32:
+		return structpb.NewNumberValue(float64(value)), nil
+	case float64:
+		return structpb.NewNumberValue(value), nil
+	case string:
+		return structpb.NewStringValue(value), nil
+	case []byte:
+		return structpb.NewStringValue(base64.StdEncoding.EncodeToString(value)), nil
+	case time.Time:
+		return structpb.NewStringValue(value.Format(time.RFC3339Nano)), nil
+	case amqp091.Decimal:
+		return structpb.NewStructValue(&structpb.Struct{Fields: map[string]*structpb.Value{
+			"Scale": structpb.NewNumberValue(float64(value.Scale)),
+			"Value": structpb.NewNumberValue(float64(value.Value)),
+		}}), nil
+	case amqp091.Table:
+		return protoStructValue(value)
+	case map[string]any:
+		return protoStructValue(value)
+	case []any:
+		values := make([]*structpb.Value, 0, len(value))
+		for _, item := range value {
+			v, err := protoValue(item)
+			if err != nil {
+				return nil, err
+			}
+			values = append(values, v)
+		}
+		return structpb.NewListValue(&structpb.ListValue{Values: values}), nil
+	default:
+		return nil, fmt.Errorf("unsupported value type %T", value)
+	}
+}
+
+func protoStructValue(table map[string]any) (*structpb.Value, error) {
+	s, err := protoStruct(table)
+	if err != nil {
+		return nil, err
+	}
+
+	return structpb.NewStructValue(s), nil
+}
@@ -0,0 +1,292 @@
+package thumper
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/bufbuild/protocompile"
+	amqp091 "github.com/rabbitmq/amqp091-go"
+	"github.com/vmihailenco/msgpack/v5"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/dynamicpb"
+	"google.golang.org/protobuf/types/known/structpb"
+	"reflect"
+	"testing"
+	"time"
+)
+
+var testHeaders = map[string]any{
+	"x-null":      nil,
+	"x-bool":      true,
+	"x-int8":      int8(-8),
+	"x-byte":      uint8(8),
+	"x-int16":     int16(-16),
+	"x-int32":     int32(32),
+	"x-int64":     int64(1 << 40),
+	"x-float32":   float32(1.5),
+	"x-float64":   2.25,
+	"x-string":    "order-42",
+	"x-bytes":     []byte{0x00, 0xff},
+	"x-timestamp": time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC),
+	"x-decimal":   amqp091.Decimal{Scale: 2, Value: 1234},
+	"x-table":     amqp091.Table{"tenant": "acme", "retries": int32(3)},
+	"x-death": []any{
+		amqp091.Table{"count": int64(1), "queue": "orders", "routing-keys": []any{"orders.created"}},
+	},
+}
+
+// jsonValue returns the value as decoded from its JSON encoding
+func jsonValue(t *testing.T, value any) any {
+	data, err := json.Marshal(value)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var decoded any
+	err = json.Unmarshal(data, &decoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return decoded
+}
+
+// compileSchema compiles proto/thumper.proto, so the encoding is checked against the published schema
+func compileSchema(t *testing.T) protoreflect.FileDescriptor {
+	compiler := protocompile.Compiler{
+		Resolver: protocompile.WithStandardImports(&protocompile.SourceResolver{ImportPaths: []string{"proto"}}),
+	}
+
+	files, err := compiler.Compile(context.Background(), "thumper.proto")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return files[0]
+}
+
+func decodeProto(t *testing.T, schema protoreflect.FileDescriptor, name string, data []byte) *dynamicpb.Message {
+	msg := dynamicpb.NewMessage(schema.Messages().ByName(protoreflect.Name(name)))
+	err := proto.Unmarshal(data, msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(msg.GetUnknown()) > 0 {
+		t.Errorf("%s has fields unknown to the schema", name)
+	}
+
+	return msg
+}
+
+func protoField(msg protoreflect.Message, name string) protoreflect.Value {
+	return msg.Get(msg.Descriptor().Fields().ByName(protoreflect.Name(name)))
+}
+
+func protoHeaders(t *testing.T, msg protoreflect.Message) map[string]any {
+	data, err := proto.Marshal(protoField(msg, "headers").Message().Interface())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var headers structpb.Struct
+	err = proto.Unmarshal(data, &headers)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return headers.AsMap()
+}
+
+func TestMessageContextProto(t *testing.T) {
+	schema := compileSchema(t)
+
+	msgContext := &MessageContext{
+		Version:     ContextVersion,
+		Queue:       "orders",
+		Headers:     testHeaders,
+		Exchange:    "events",
+		RoutingKey:  "orders.created",
+		DeliveryTag: 42,
+		BodyID:      "QWERTY",
+		BodySize:    64 << 20,
+		Trace:       map[string]string{"traceparent": "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01"},
+	}
+
+	data, err := encodeContext(CodecProto, msgContext)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := decodeProto(t, schema, "MessageContext", data)
+
+	if got := protoField(msg, "version").Uint(); got != ContextVersion {
+		t.Errorf("version %d", got)
+	}
+	for field, want := range map[string]string{"queue": "orders", "exchange": "events", "routing_key": "orders.created", "body_id": "QWERTY"} {
+		if got := protoField(msg, field).String(); got != want {
+			t.Errorf("%s is %q, expected %q", field, got, want)
+		}
+	}
+	if got := protoField(msg, "delivery_tag").Uint(); got != 42 {
+		t.Errorf("delivery tag %d", got)
+	}
+	if got := protoField(msg, "body_size").Uint(); got != 64<<20 {
+		t.Errorf("body size %d", got)
+	}
+	if got := protoField(msg, "trace").Map().Get(protoreflect.ValueOfString("traceparent").MapKey()).String(); got != msgContext.Trace["traceparent"] {
+		t.Errorf("traceparent %q", got)
+	}
+
+	if got, want := protoHeaders(t, msg), jsonValue(t, testHeaders); !reflect.DeepEqual(got, want) {
+		t.Errorf("headers differ from their JSON encoding:\n%v\n%v", got, want)
+	}
+}
+
+func TestBatchContextProto(t *testing.T) {
+	schema := compileSchema(t)
+
+	msgContext := &BatchContext{
+		Version: ContextVersion,
+		Queue:   "orders",
+		Messages: []*BatchMessageContext{
+			{Headers: testHeaders, Exchange: "events", RoutingKey: "orders.created", DeliveryTag: 1},
+			{RoutingKey: "orders.paid", DeliveryTag: 2},
+		},
+		Trace: map[string]string{"traceparent": "00-01"},
+	}
+
+	data, err := encodeContext(CodecProto, msgContext)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := decodeProto(t, schema, "BatchContext", data)
+
+	if got := protoField(msg, "queue").String(); got != "orders" {
+		t.Errorf("queue %q", got)
+	}
+	messages := protoField(msg, "messages").List()
+	if messages.Len() != 2 {
+		t.Fatalf("%d messages, expected 2", messages.Len())
+	}
+
+	first, second := messages.Get(0).Message(), messages.Get(1).Message()
+	if got, want := protoHeaders(t, first), jsonValue(t, testHeaders); !reflect.DeepEqual(got, want) {
+		t.Errorf("headers differ from their JSON encoding:\n%v\n%v", got, want)
+	}
+	if protoField(first, "exchange").String() != "events" || protoField(first, "delivery_tag").Uint() != 1 {
+		t.Errorf("unexpected first message %v", first)
+	}
+	if protoField(second, "routing_key").String() != "orders.paid" || protoField(second, "delivery_tag").Uint() != 2 {
+		t.Errorf("unexpected second message %v", second)
+	}
+	if second.Has(second.Descriptor().Fields().ByName("headers")) {
+		t.Error("empty headers are encoded")
+	}
+
+	body, err := encodeBodies(CodecProto, [][]byte{[]byte("first"), {}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	bodies := protoField(decodeProto(t, schema, "BatchBody", body), "bodies").List()
+	if bodies.Len() != 2 || string(bodies.Get(0).Bytes()) != "first" || len(bodies.Get(1).Bytes()) != 0 {
+		t.Errorf("unexpected bodies %v", bodies)
+	}
+}
+
+func TestProtoValueUnsupported(t *testing.T) {
+	_, err := appendProtoHeaders(nil, 1, map[string]any{"x-channel": make(chan int)})
+	if err == nil {
+		t.Error("expected an error")
+	}
+}
+
+func TestMessageContextRoundTrip(t *testing.T) {
+	msgContext := &MessageContext{
+		Version:     ContextVersion,
+		Queue:       "orders",
+		Headers:     map[string]any{"x-string": "order-42", "x-count": int64(3), "x-bool": true},
+		Exchange:    "events",
+		RoutingKey:  "orders.created",
+		DeliveryTag: 42,
+		Trace:       map[string]string{"traceparent": "00-01"},
+	}
+
+	decode := map[string]func(data []byte, v any) error{
+		CodecJSON:    json.Unmarshal,
+		CodecMsgpack: msgpack.Unmarshal,
+	}
+
+	for codec, decode := range decode {
+		t.Run(codec, func(t *testing.T) {
+			data, err := encodeContext(codec, msgContext)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var decoded MessageContext
+			err = decode(data, &decoded)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if decoded.Queue != msgContext.Queue || decoded.Exchange != msgContext.Exchange || decoded.RoutingKey != msgContext.RoutingKey ||
+				decoded.DeliveryTag != msgContext.DeliveryTag || decoded.Version != msgContext.Version || decoded.BodyID != "" {
+				t.Errorf("decoded %+v, expected %+v", decoded, msgContext)
+			}
+			if !reflect.DeepEqual(decoded.Trace, msgContext.Trace) {
+				t.Errorf("trace %v", decoded.Trace)
+			}
+			if got, want := jsonValue(t, decoded.Headers), jsonValue(t, msgContext.Headers); !reflect.DeepEqual(got, want) {
+				t.Errorf("headers %v, expected %v", got, want)
+			}
+		})
+	}
+}
+
+func TestBatchContextRoundTrip(t *testing.T) {
+	msgContext := &BatchContext{
+		Version: ContextVersion,
+		Queue:   "orders",
+		Messages: []*BatchMessageContext{
+			{Headers: map[string]any{"x-string": "order-42"}, Exchange: "events", RoutingKey: "orders.created", DeliveryTag: 1},
+			{RoutingKey: "orders.paid", DeliveryTag: 2},
+		},
+	}
+
+	decode := map[string]func(data []byte, v any) error{
+		CodecJSON:    json.Unmarshal,
+		CodecMsgpack: msgpack.Unmarshal,
+	}
+
+	for codec, decode := range decode {
+		t.Run(codec, func(t *testing.T) {
+			data, err := encodeContext(codec, msgContext)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var decoded BatchContext
+			err = decode(data, &decoded)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !reflect.DeepEqual(&decoded, msgContext) {
+				t.Errorf("decoded %+v, expected %+v", decoded, msgContext)
+			}
+		})
+	}
+}
+
+func TestContextCodec(t *testing.T) {
+	for _, codec := range []string{"", CodecJSON, CodecMsgpack, CodecProto} {
+		_, err := contextCodec(codec)
+		if err != nil {
+			t.Errorf("%s: %v", codec, err)
+		}
+	}
+
+	_, err := contextCodec("xml")
+	if err == nil {
+		t.Error("expected an error for an unknown codec")
+	}
+}
@@ -0,0 +1,101 @@
+package thumper
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/klauspost/compress/gzip"
+	"github.com/klauspost/compress/snappy"
+	"github.com/klauspost/compress/zstd"
+	"io"
+	"sync"
+)
+
+const (
+	EncodingGzip   = "gzip"
+	EncodingZstd   = "zstd"
+	EncodingSnappy = "snappy"
+)
+
+// defaultMaxDecompressedSize guards against decompression bombs
+const defaultMaxDecompressedSize = 64 << 20
+
+// zstdEncoder is shared by all publishes, EncodeAll is safe for concurrent use
+var zstdEncoder = sync.OnceValues(func() (*zstd.Encoder, error) {
+	return zstd.NewWriter(nil)
+})
+
+// decompress decodes the body of a known content encoding, other bodies are returned unchanged.
+// Bodies decompressing to more than maxSize bytes are rejected.
+func decompress(encoding string, body []byte, maxSize int64) ([]byte, error) {
+	switch encoding {
+	case EncodingGzip:
+		reader, err := gzip.NewReader(bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		defer reader.Close()
+
+		return readLimited(reader, maxSize)
+	case EncodingZstd:
+		decoder, err := zstd.NewReader(bytes.NewReader(body), zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return nil, err
+		}
+		defer decoder.Close()
+
+		return readLimited(decoder, maxSize)
+	case EncodingSnappy:
+		size, err := snappy.DecodedLen(body)
+		if err != nil {
+			return nil, err
+		}
+		if int64(size) > maxSize {
+			return nil, fmt.Errorf("decompressed body exceeds %d bytes", maxSize)
+		}
+
+		return snappy.Decode(nil, body)
+	default:
+		return body, nil
+	}
+}
+
+func readLimited(reader io.Reader, maxSize int64) ([]byte, error) {
+	body, err := io.ReadAll(io.LimitReader(reader, maxSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(body)) > maxSize {
+		return nil, fmt.Errorf("decompressed body exceeds %d bytes", maxSize)
+	}
+
+	return body, nil
+}
+
+func compress(encoding string, body []byte) ([]byte, error) {
+	switch encoding {
+	case EncodingGzip:
+		var buf bytes.Buffer
+		writer := gzip.NewWriter(&buf)
+		_, err := writer.Write(body)
+		if err != nil {
+			return nil, err
+		}
+		err = writer.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		return buf.Bytes(), nil
+	case EncodingZstd:
+		encoder, err := zstdEncoder()
+		if err != nil {
+			return nil, err
+		}
+
+		return encoder.EncodeAll(body, nil), nil
+	case EncodingSnappy:
+		return snappy.Encode(nil, body), nil
+	default:
+		return nil, fmt.Errorf("unknown encoding %s, expected gzip, zstd or snappy", encoding)
+	}
+}
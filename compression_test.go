@@ -0,0 +1,104 @@
+package thumper
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestCompressRoundTrip(t *testing.T) {
+	body := []byte(strings.Repeat("thumper ", 1000))
+
+	for _, encoding := range []string{EncodingGzip, EncodingZstd, EncodingSnappy} {
+		t.Run(encoding, func(t *testing.T) {
+			compressed, err := compress(encoding, body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(compressed) >= len(body) {
+				t.Errorf("compressed to %d bytes, expected less than %d", len(compressed), len(body))
+			}
+
+			decompressed, err := decompress(encoding, compressed, defaultMaxDecompressedSize)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(decompressed, body) {
+				t.Error("decompressed body differs")
+			}
+		})
+	}
+}
+
+func TestDecompressLimit(t *testing.T) {
+	body := bytes.Repeat([]byte{0}, 1<<20)
+
+	tests := []struct {
+		encoding string
+		maxSize  int64
+		wantErr  bool
+	}{
+		{EncodingGzip, 1 << 20, false},
+		{EncodingGzip, 1<<20 - 1, true},
+		{EncodingZstd, 1 << 20, false},
+		{EncodingZstd, 1<<20 - 1, true},
+		{EncodingSnappy, 1 << 20, false},
+		{EncodingSnappy, 1<<20 - 1, true},
+	}
+
+	for _, tt := range tests {
+		compressed, err := compress(tt.encoding, body)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		decompressed, err := decompress(tt.encoding, compressed, tt.maxSize)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("%s with limit %d: expected an error", tt.encoding, tt.maxSize)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s with limit %d: %v", tt.encoding, tt.maxSize, err)
+		}
+		if len(decompressed) != len(body) {
+			t.Errorf("%s with limit %d: decompressed %d bytes, expected %d", tt.encoding, tt.maxSize, len(decompressed), len(body))
+		}
+	}
+}
+
+func TestDecompress(t *testing.T) {
+	tests := []struct {
+		name     string
+		encoding string
+		body     []byte
+		want     []byte
+		wantErr  bool
+	}{
+		{name: "identity", encoding: "", body: []byte("plain"), want: []byte("plain")},
+		{name: "unknown encoding", encoding: "br", body: []byte("plain"), want: []byte("plain")},
+		{name: "malformed gzip", encoding: EncodingGzip, body: []byte("plain"), wantErr: true},
+		{name: "malformed zstd", encoding: EncodingZstd, body: []byte("plain"), wantErr: true},
+		{name: "malformed snappy", encoding: EncodingSnappy, body: []byte{0xff, 0xff, 0xff, 0xff, 0xff}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := decompress(tt.encoding, tt.body, defaultMaxDecompressedSize)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("unexpected error %v", err)
+			}
+			if !bytes.Equal(got, tt.want) {
+				t.Errorf("got %q, expected %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCompressUnknownEncoding(t *testing.T) {
+	_, err := compress("br", []byte("body"))
+	if err == nil {
+		t.Error("expected an error")
+	}
+}
@@ -1,25 +1,148 @@
 package thumper
 
 import (
+	"fmt"
 	"github.com/roadrunner-server/config/v5"
 	"github.com/roadrunner-server/pool/pool"
+	"net/url"
 	"os"
+	"strings"
+	"time"
+)
+
+const (
+	// ResetQuiesce pauses dispatching, waits for in-flight executions and resets the whole pool
+	ResetQuiesce = "quiesce"
+	// ResetRolling replaces the workers one by one while messages are processed
+	ResetRolling = "rolling"
 )
 
 type Config struct {
 	Amqp *AmqpConfig `mapstructure:"amqp"`
 
 	Pool *pool.Config `mapstructure:"pool"`
+	// Pools are dedicated worker pools, consumers reference them by name
+	Pools map[string]*PoolConfig `mapstructure:"pools"`
 
 	Consumers []*ConsumerConfig `mapstructure:"consumers"`
+
+	// Compression compresses bodies of messages published over RPC
+	Compression *CompressionConfig `mapstructure:"compression"`
+
+	// ResetMode is quiesce (default) or rolling
+	ResetMode string `mapstructure:"reset_mode"`
+
+	// ShutdownTimeout is how long in-flight messages can take on stop before they are requeued, defaults to 30s
+	ShutdownTimeout time.Duration `mapstructure:"shutdown_timeout"`
+
+	// DynamicConsumersFile persists consumers added over RPC, they are restored on start
+	DynamicConsumersFile string `mapstructure:"dynamic_consumers_file"`
+}
+
+// CompressionConfig compresses published bodies larger than Threshold bytes and sets their content encoding
+type CompressionConfig struct {
+	// Encoding is gzip (default), zstd or snappy
+	Encoding string `mapstructure:"encoding"`
+	// Threshold defaults to 1024
+	Threshold int `mapstructure:"threshold"`
+}
+
+type PoolConfig struct {
+	pool.Config `mapstructure:",squash"`
+
+	Env map[string]string `mapstructure:"env"`
 }
 
 type AmqpConfig struct {
 	Addr string `mapstructure:"addr"`
+	// AddrFile reads the address from a file instead, e.g. a mounted secret
+	AddrFile string `mapstructure:"addr_file"`
+	// Username, Password and Vhost replace the parts of the address when set
+	Username     string `mapstructure:"username"`
+	UsernameFile string `mapstructure:"username_file"`
+	Password     string `mapstructure:"password"`
+	PasswordFile string `mapstructure:"password_file"`
+	Vhost        string `mapstructure:"vhost"`
 
-	Queue     []*QueueConfig     `mapstructure:"queue"`
-	Exchange  []*ExchangeConfig  `mapstructure:"exchange"`
-	QueueBind []*QueueBindConfig `mapstructure:"queueBind"`
+	Queue       []*QueueConfig       `mapstructure:"queue"`
+	Exchange    []*ExchangeConfig    `mapstructure:"exchange"`
+	QueueBind   []*QueueBindConfig   `mapstructure:"queueBind"`
+	SuperStream []*SuperStreamConfig `mapstructure:"superStream"`
+}
+
+// URL returns the connection address, the files are read on every call, so rotated secrets are used on reconnect
+func (c *AmqpConfig) URL() (string, error) {
+	addr, err := secret(c.Addr, c.AddrFile)
+	if err != nil {
+		return "", err
+	}
+
+	username, err := secret(c.Username, c.UsernameFile)
+	if err != nil {
+		return "", err
+	}
+
+	password, err := secret(c.Password, c.PasswordFile)
+	if err != nil {
+		return "", err
+	}
+
+	if username == "" && password == "" && c.Vhost == "" {
+		return addr, nil
+	}
+
+	u, err := url.Parse(addr)
+	if err != nil {
+		// the address may contain credentials, don't include it in the error
+		return "", fmt.Errorf("malformed amqp address")
+	}
+
+	if username != "" || password != "" {
+		if username == "" {
+			username = u.User.Username()
+		}
+		if password == "" {
+			password, _ = u.User.Password()
+		}
+		u.User = url.UserPassword(username, password)
+	}
+
+	if c.Vhost != "" {
+		u.Path = "/" + c.Vhost
+		u.RawPath = "/" + url.PathEscape(c.Vhost)
+	}
+
+	return u.String(), nil
+}
+
+// secret returns the value, or the content of the file when it's set
+func secret(value, file string) (string, error) {
+	if file == "" {
+		return value, nil
+	}
+
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return "", fmt.Errorf("failed to read secret file: %w", err)
+	}
+
+	// mounted secrets often end with a newline
+	return strings.TrimRight(string(data), "\r\n"), nil
+}
+
+// singleActiveConsumer reports whether the queue may be a single active consumer queue,
+// queues not declared in the config may be
+func (c *AmqpConfig) singleActiveConsumer(name string) bool {
+	for _, queue := range c.Queue {
+		if queue.Name != name {
+			continue
+		}
+
+		singleActive, _ := queue.Args["x-single-active-consumer"].(bool)
+		return queue.SingleActiveConsumer || singleActive
+	}
+
+	return true
 }
 
 type QueueConfig struct {
@@ -29,6 +152,122 @@ type QueueConfig struct {
 	Exclusive  bool                   `mapstructure:"exclusive"`
 	NoWait     bool                   `mapstructure:"noWait"`
 	Args       map[string]interface{} `mapstructure:"args"`
+
+	// Type is classic, quorum or stream, the broker default is used when empty
+	Type                 string        `mapstructure:"type"`
+	DeadLetterExchange   string        `mapstructure:"deadLetterExchange"`
+	DeadLetterRoutingKey string        `mapstructure:"deadLetterRoutingKey"`
+	MessageTTL           time.Duration `mapstructure:"messageTtl"`
+	MaxLength            int64         `mapstructure:"maxLength"`
+	MaxLengthBytes       int64         `mapstructure:"maxLengthBytes"`
+	// Overflow is drop-head, reject-publish or reject-publish-dlx
+	Overflow             string `mapstructure:"overflow"`
+	DeliveryLimit        int64  `mapstructure:"deliveryLimit"`
+	MaxPriority          int64  `mapstructure:"maxPriority"`
+	SingleActiveConsumer bool   `mapstructure:"singleActiveConsumer"`
+	// Expires deletes the queue after it's unused for the duration
+	Expires time.Duration `mapstructure:"expires"`
+}
+
+const (
+	QueueClassic = "classic"
+	QueueQuorum  = "quorum"
+	QueueStream  = "stream"
+)
+
+// Arguments returns the queue declaration arguments, the typed fields are converted to x- arguments.
+// Setting an argument both as a field and in args is an error.
+func (c *QueueConfig) Arguments() (map[string]interface{}, error) {
+	args := make(map[string]interface{}, len(c.Args))
+	for key, value := range c.Args {
+		args[key] = value
+	}
+
+	var err error
+	set := func(field, key string, value interface{}) {
+		if err != nil {
+			return
+		}
+		if _, ok := c.Args[key]; ok {
+			err = fmt.Errorf("%s conflicts with %s in args", field, key)
+			return
+		}
+		args[key] = value
+	}
+
+	switch c.Type {
+	case "":
+	case QueueClassic, QueueQuorum, QueueStream:
+		if c.Type != QueueClassic && (!c.Durable || c.Exclusive || c.AutoDelete) {
+			return nil, fmt.Errorf("%s queues must be durable, non-exclusive and not auto-deleted", c.Type)
+		}
+		set("type", "x-queue-type", c.Type)
+	default:
+		return nil, fmt.Errorf("unknown type %s, expected classic, quorum or stream", c.Type)
+	}
+
+	if c.DeadLetterExchange != "" {
+		set("deadLetterExchange", "x-dead-letter-exchange", c.DeadLetterExchange)
+	}
+	if c.DeadLetterRoutingKey != "" {
+		set("deadLetterRoutingKey", "x-dead-letter-routing-key", c.DeadLetterRoutingKey)
+	}
+
+	if c.MessageTTL < 0 || (c.MessageTTL > 0 && c.MessageTTL < time.Millisecond) {
+		return nil, fmt.Errorf("messageTtl must be at least 1ms")
+	}
+	if c.MessageTTL > 0 {
+		set("messageTtl", "x-message-ttl", c.MessageTTL.Milliseconds())
+	}
+
+	if c.MaxLength < 0 || c.MaxLengthBytes < 0 {
+		return nil, fmt.Errorf("maxLength and maxLengthBytes must not be negative")
+	}
+	if c.MaxLength > 0 {
+		set("maxLength", "x-max-length", c.MaxLength)
+	}
+	if c.MaxLengthBytes > 0 {
+		set("maxLengthBytes", "x-max-length-bytes", c.MaxLengthBytes)
+	}
+
+	switch c.Overflow {
+	case "":
+	case "drop-head", "reject-publish", "reject-publish-dlx":
+		set("overflow", "x-overflow", c.Overflow)
+	default:
+		return nil, fmt.Errorf("unknown overflow %s, expected drop-head, reject-publish or reject-publish-dlx", c.Overflow)
+	}
+
+	if c.DeliveryLimit != 0 {
+		if c.Type != QueueQuorum || c.DeliveryLimit < 0 {
+			return nil, fmt.Errorf("deliveryLimit must be positive and requires type quorum")
+		}
+		set("deliveryLimit", "x-delivery-limit", c.DeliveryLimit)
+	}
+
+	if c.MaxPriority != 0 {
+		if c.MaxPriority < 0 || c.MaxPriority > 255 || (c.Type != "" && c.Type != QueueClassic) {
+			return nil, fmt.Errorf("maxPriority must be between 1 and 255 and requires a classic queue")
+		}
+		set("maxPriority", "x-max-priority", c.MaxPriority)
+	}
+
+	if c.SingleActiveConsumer {
+		set("singleActiveConsumer", "x-single-active-consumer", true)
+	}
+
+	if c.Expires < 0 || (c.Expires > 0 && c.Expires < time.Millisecond) {
+		return nil, fmt.Errorf("expires must be at least 1ms")
+	}
+	if c.Expires > 0 {
+		set("expires", "x-expires", c.Expires.Milliseconds())
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return args, nil
 }
 
 type ExchangeConfig struct {
@@ -49,16 +288,125 @@ type QueueBindConfig struct {
 	Args     map[string]interface{} `mapstructure:"args"`
 }
 
+// SuperStreamConfig declares a partitioned stream, a direct exchange bound to streams <name>-0 ... <name>-N.
+// Messages published to the exchange over RPC are routed to a partition by hashing the routing key or a header.
+type SuperStreamConfig struct {
+	Name       string `mapstructure:"name"`
+	Partitions int    `mapstructure:"partitions"`
+	// RoutingHeader is hashed instead of the routing key when set
+	RoutingHeader string `mapstructure:"routingHeader"`
+	// Args are added to the partition stream arguments, e.g. x-max-length-bytes
+	Args map[string]interface{} `mapstructure:"args"`
+}
+
 type ConsumerConfig struct {
 	Queue string `mapstructure:"queue"`
 
 	Prefetch      int   `mapstructure:"prefetch"`
-	Durable       bool  `mapstructure:"durable"`
 	RequeueOnFail *bool `mapstructure:"requeue_on_fail"`
 
 	ConsumerID string `mapstructure:"consumer_id"`
 
+	// Priority is sent as the x-priority consumer argument
+	Priority  int                    `mapstructure:"priority"`
+	Exclusive bool                   `mapstructure:"exclusive"`
+	NoLocal   bool                   `mapstructure:"no_local"`
+	AutoAck   bool                   `mapstructure:"auto_ack"`
+	Args      map[string]interface{} `mapstructure:"args"`
+
+	// StandbyScaleDown removes the consumer's share of workers (concurrency) from the pool
+	// while it's on standby, e.g. on single active consumer queues
+	StandbyScaleDown bool `mapstructure:"standby_scale_down"`
+
 	Concurrency int `mapstructure:"concurrency"`
+
+	// Weight is the share of the pool the consumer gets when other consumers of the pool are backlogged, defaults to 1
+	Weight int `mapstructure:"weight"`
+	// MaxInFlight limits messages of the consumer processed at once by the pool, unlimited when 0
+	MaxInFlight int `mapstructure:"max_in_flight"`
+
+	// OrderingKey allows at most one in-flight message per key, messages of different keys are processed in parallel.
+	// It's a header name (header:<name>), routing_key, a routing key segment (routing_key:<n>) or a JSON path in the body (body:<path>).
+	OrderingKey string `mapstructure:"ordering_key"`
+	// KeyConcurrency limits in-flight messages per key, e.g. per tenant
+	KeyConcurrency *KeyConcurrencyConfig `mapstructure:"key_concurrency"`
+
+	// Decompress decodes gzip, zstd and snappy content encodings before the body is sent to the worker
+	Decompress bool `mapstructure:"decompress"`
+	// MaxDecompressedSize rejects bodies larger than this when decompressed, defaults to 64 MiB
+	MaxDecompressedSize int64 `mapstructure:"max_decompressed_size"`
+
+	// LargeBody lets the worker read large bodies in chunks instead of receiving them in the payload
+	LargeBody *LargeBodyConfig `mapstructure:"large_body"`
+
+	// Codec encodes the message context sent to the worker: json (default), msgpack or proto
+	Codec string `mapstructure:"codec"`
+
+	// Batch groups deliveries into a single execution
+	Batch *BatchConfig `mapstructure:"batch"`
+
+	// ExecTimeout limits a single execution, the worker is killed and replaced when it's reached
+	ExecTimeout time.Duration `mapstructure:"exec_timeout"`
+
+	DeadLetter *DeadLetterConfig `mapstructure:"dead_letter"`
+
+	// Pool is the name of the dedicated pool processing the messages, the default pool is used when empty
+	Pool string `mapstructure:"pool"`
+
+	// Stream enables consuming from a stream queue
+	Stream *StreamConfig `mapstructure:"stream"`
+}
+
+// DeadLetterConfig republishes failed messages with diagnostic headers instead of nacking them.
+type DeadLetterConfig struct {
+	// Exchange is the default exchange when empty, RoutingKey is required then
+	Exchange string `mapstructure:"exchange"`
+	// RoutingKey defaults to the routing key of the failed message
+	RoutingKey string `mapstructure:"routing_key"`
+}
+
+// BatchConfig dispatches up to Size messages at once, a batch is dispatched when it's full or Wait after its first message.
+// The worker responds with a result for each message.
+type BatchConfig struct {
+	// Size defaults to 100
+	Size int `mapstructure:"size"`
+	// Wait defaults to 1s
+	Wait time.Duration `mapstructure:"wait"`
+}
+
+// LargeBodyConfig keeps bodies larger than Threshold bytes out of the payload,
+// the worker reads them in chunks over RPC until it responds.
+type LargeBodyConfig struct {
+	// Threshold defaults to 8 MiB
+	Threshold int `mapstructure:"threshold"`
+}
+
+// KeyConcurrencyConfig allows up to Limit in-flight messages with the same key,
+// the key has the same format as ConsumerConfig.OrderingKey.
+// Excess messages are held locally, within the prefetch window.
+type KeyConcurrencyConfig struct {
+	Key   string `mapstructure:"key"`
+	Limit int    `mapstructure:"limit"`
+}
+
+type StreamConfig struct {
+	// Offset to start from without a stored offset: first, last, next (default),
+	// an absolute offset, an RFC 3339 timestamp or an interval like 1D or 12h
+	Offset string `mapstructure:"offset"`
+
+	// OffsetStore persists the last processed offset: file or queue, it's not persisted when empty
+	OffsetStore string `mapstructure:"offset_store"`
+	// OffsetFile defaults to <consumer_id or queue>.offset
+	OffsetFile string `mapstructure:"offset_file"`
+	// OffsetQueue defaults to thumper.offset.<consumer_id or queue>
+	OffsetQueue string `mapstructure:"offset_queue"`
+	// FlushInterval is how often the offset is persisted, defaults to 5s
+	FlushInterval time.Duration `mapstructure:"flush_interval"`
+
+	// Filter receives only messages published with one of the x-stream-filter-value values
+	Filter []string `mapstructure:"filter"`
+	// MatchUnfiltered receives also messages published without a filter value
+	MatchUnfiltered bool `mapstructure:"match_unfiltered"`
 }
 
 func (c *Config) InitDefaults() {
@@ -66,47 +414,206 @@ func (c *Config) InitDefaults() {
 		c.Pool.InitDefaults()
 	}
 
+	for name, poolConfig := range c.Pools {
+		if poolConfig == nil {
+			poolConfig = &PoolConfig{}
+			c.Pools[name] = poolConfig
+		}
+		poolConfig.InitDefaults()
+	}
+
+	if c.ShutdownTimeout == 0 {
+		c.ShutdownTimeout = 30 * time.Second
+	}
+
+	if c.Compression != nil {
+		if c.Compression.Encoding == "" {
+			c.Compression.Encoding = EncodingGzip
+		}
+		if c.Compression.Threshold == 0 {
+			c.Compression.Threshold = 1024
+		}
+	}
+
 	for _, consumer := range c.Consumers {
 		consumer.InitDefaults()
 	}
 }
 
+// unboundedExecTTL is the exec_ttl of pools configured without one
+const unboundedExecTTL = 100 * 365 * 24 * time.Hour
+
+// supervisedPoolConfig returns the config the pool is created with. The pool runs executions under the caller's context
+// only with exec_ttl set, so a pool without one gets an unbounded exec_ttl, and executions are bounded by the exec_timeout
+// of their consumer and by stop. The user's config is not modified.
+func supervisedPoolConfig(cfg *pool.Config) *pool.Config {
+	if cfg.Supervisor != nil && cfg.Supervisor.ExecTTL != 0 {
+		return cfg
+	}
+
+	supervised := *cfg
+	supervised.Supervisor = &pool.SupervisorConfig{}
+	if cfg.Supervisor != nil {
+		*supervised.Supervisor = *cfg.Supervisor
+	}
+	supervised.Supervisor.ExecTTL = unboundedExecTTL
+	supervised.Supervisor.InitDefaults()
+
+	return &supervised
+}
+
 func (c *ConsumerConfig) InitDefaults() {
+	if c.Batch != nil {
+		if c.Batch.Size == 0 {
+			c.Batch.Size = 100
+		}
+		if c.Batch.Wait == 0 {
+			c.Batch.Wait = time.Second
+		}
+		// a full batch needs that many unacked messages
+		if c.Prefetch == 0 {
+			c.Prefetch = c.Batch.Size
+		}
+	}
+
 	if c.Prefetch == 0 {
 		c.Prefetch = 1
 	}
 
+	if c.Weight == 0 {
+		c.Weight = 1
+	}
+
+	if c.LargeBody != nil && c.LargeBody.Threshold == 0 {
+		c.LargeBody.Threshold = 8 << 20
+	}
+
+	if c.MaxDecompressedSize == 0 {
+		c.MaxDecompressedSize = defaultMaxDecompressedSize
+	}
+
 	if c.RequeueOnFail == nil {
 		requeueOnFail := true
 		c.RequeueOnFail = &requeueOnFail
 	}
+
+	if c.Stream != nil {
+		name := c.ConsumerID
+		if name == "" {
+			name = c.Queue
+		}
+		c.Stream.InitDefaults(name)
+	}
+}
+
+func (c *StreamConfig) InitDefaults(name string) {
+	if c.OffsetFile == "" {
+		c.OffsetFile = name + ".offset"
+	}
+
+	if c.OffsetQueue == "" {
+		c.OffsetQueue = "thumper.offset." + name
+	}
+
+	if c.FlushInterval == 0 {
+		c.FlushInterval = 5 * time.Second
+	}
+}
+
+// ConsumeArgs returns the basic.consume arguments
+func (c *ConsumerConfig) ConsumeArgs() map[string]interface{} {
+	args := make(map[string]interface{}, len(c.Args)+1)
+	for key, value := range c.Args {
+		args[key] = value
+	}
+
+	if c.Priority != 0 {
+		args["x-priority"] = c.Priority
+	}
+
+	if c.Stream != nil && len(c.Stream.Filter) > 0 {
+		filter := make([]interface{}, 0, len(c.Stream.Filter))
+		for _, value := range c.Stream.Filter {
+			filter = append(filter, value)
+		}
+		args["x-stream-filter"] = filter
+		args["x-stream-match-unfiltered"] = c.Stream.MatchUnfiltered
+	}
+
+	return args
 }
 
 func (c *Config) ExpandEnv() {
+	c.DynamicConsumersFile = config.ExpandVal(c.DynamicConsumersFile, os.Getenv)
+
 	for _, consumer := range c.Consumers {
 		consumer.ExpandEnv()
 	}
 
-	for _, queue := range c.Amqp.Queue {
+	if c.Amqp != nil {
+		c.Amqp.ExpandEnv()
+	}
+}
+
+func (c *AmqpConfig) ExpandEnv() {
+	c.Addr = config.ExpandVal(c.Addr, os.Getenv)
+	c.AddrFile = config.ExpandVal(c.AddrFile, os.Getenv)
+	c.Username = config.ExpandVal(c.Username, os.Getenv)
+	c.UsernameFile = config.ExpandVal(c.UsernameFile, os.Getenv)
+	c.Password = config.ExpandVal(c.Password, os.Getenv)
+	c.PasswordFile = config.ExpandVal(c.PasswordFile, os.Getenv)
+	c.Vhost = config.ExpandVal(c.Vhost, os.Getenv)
+
+	for _, queue := range c.Queue {
 		queue.ExpandEnv()
 	}
 
-	for _, exchange := range c.Amqp.Exchange {
+	for _, exchange := range c.Exchange {
 		exchange.ExpandEnv()
 	}
 
-	for _, queueBind := range c.Amqp.QueueBind {
+	for _, queueBind := range c.QueueBind {
 		queueBind.ExpandEnv()
 	}
+
+	for _, superStream := range c.SuperStream {
+		superStream.ExpandEnv()
+	}
 }
 
 func (c *ConsumerConfig) ExpandEnv() {
 	c.Queue = config.ExpandVal(c.Queue, os.Getenv)
 	c.ConsumerID = config.ExpandVal(c.ConsumerID, os.Getenv)
+	c.Pool = config.ExpandVal(c.Pool, os.Getenv)
+	c.OrderingKey = config.ExpandVal(c.OrderingKey, os.Getenv)
+	if c.KeyConcurrency != nil {
+		c.KeyConcurrency.Key = config.ExpandVal(c.KeyConcurrency.Key, os.Getenv)
+	}
+	for key, value := range c.Args {
+		if valueStr, ok := value.(string); ok {
+			c.Args[key] = config.ExpandVal(valueStr, os.Getenv)
+		}
+	}
+
+	if c.Stream != nil {
+		c.Stream.Offset = config.ExpandVal(c.Stream.Offset, os.Getenv)
+		c.Stream.OffsetFile = config.ExpandVal(c.Stream.OffsetFile, os.Getenv)
+		c.Stream.OffsetQueue = config.ExpandVal(c.Stream.OffsetQueue, os.Getenv)
+		for i, value := range c.Stream.Filter {
+			c.Stream.Filter[i] = config.ExpandVal(value, os.Getenv)
+		}
+	}
+
+	if c.DeadLetter != nil {
+		c.DeadLetter.Exchange = config.ExpandVal(c.DeadLetter.Exchange, os.Getenv)
+		c.DeadLetter.RoutingKey = config.ExpandVal(c.DeadLetter.RoutingKey, os.Getenv)
+	}
 }
 
 func (c *QueueConfig) ExpandEnv() {
 	c.Name = config.ExpandVal(c.Name, os.Getenv)
+	c.DeadLetterExchange = config.ExpandVal(c.DeadLetterExchange, os.Getenv)
+	c.DeadLetterRoutingKey = config.ExpandVal(c.DeadLetterRoutingKey, os.Getenv)
 	for key, value := range c.Args {
 		if valueStr, ok := value.(string); ok {
 			c.Args[key] = config.ExpandVal(valueStr, os.Getenv)
@@ -134,3 +641,13 @@ func (c *QueueBindConfig) ExpandEnv() {
 		}
 	}
 }
+
+func (c *SuperStreamConfig) ExpandEnv() {
+	c.Name = config.ExpandVal(c.Name, os.Getenv)
+	c.RoutingHeader = config.ExpandVal(c.RoutingHeader, os.Getenv)
+	for key, value := range c.Args {
+		if valueStr, ok := value.(string); ok {
+			c.Args[key] = config.ExpandVal(valueStr, os.Getenv)
+		}
+	}
+}
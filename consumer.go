@@ -0,0 +1,345 @@
+package thumper
+
+import (
+	"context"
+	"fmt"
+	"github.com/dstrop/thumper/amqp"
+	"github.com/dstrop/thumper/common"
+	"go.uber.org/zap"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// brokerConsumer receives the deliveries of a consumer from the broker, it's implemented by amqp.Consumer
+type brokerConsumer interface {
+	Consume() error
+	Deliveries() <-chan amqp.Delivery
+	Delivered() uint64
+	Tag() string
+	State() (amqp.ConsumerState, time.Time)
+	Pause() error
+	Resume() error
+	Paused() bool
+	WaitCancelled(ctx context.Context) error
+	Forwarding() bool
+	ChannelOpen() bool
+	Close() error
+}
+
+// consumer is a running amqp consumer created from the ConsumerConfig
+type consumer struct {
+	cfg  *ConsumerConfig
+	amqp brokerConsumer
+	// definition is set for consumers added at runtime
+	definition map[string]any
+
+	log  *zap.Logger
+	pool common.Pool
+
+	// offsets is set for stream consumers
+	offsets *offsetTracker
+
+	// keys extract the message keys limited to keyLimits in-flight messages each
+	keys      []keyExtractor
+	keyLimits []int
+	// held returns the number of messages waiting for their key, it's set once the worker pool consumes
+	held func() int
+
+	// singleActive is set when the queue may be a single active consumer queue
+	singleActive bool
+
+	// finished counts deliveries the worker is done with, compared with the delivered count to get in-flight messages
+	finished atomic.Uint64
+
+	// scaledDown is the number of workers removed from the pool while on standby
+	scaledDown atomic.Int32
+	scaleMu    sync.Mutex
+
+	stopped atomic.Bool
+}
+
+func newConsumer(cfg *ConsumerConfig, pool common.Pool, log *zap.Logger) *consumer {
+	return &consumer{
+		cfg:  cfg,
+		log:  log,
+		pool: pool,
+	}
+}
+
+func (c *consumer) start(client *amqp.Client) error {
+	_, err := contextCodec(c.cfg.Codec)
+	if err != nil {
+		return err
+	}
+
+	orderingKey, err := parseKeyExtractor(c.cfg.OrderingKey)
+	if err != nil {
+		return fmt.Errorf("invalid ordering_key: %w", err)
+	}
+	if orderingKey != nil {
+		c.keys = append(c.keys, orderingKey)
+		c.keyLimits = append(c.keyLimits, 1)
+	}
+
+	if c.cfg.KeyConcurrency != nil {
+		key, err := parseKeyExtractor(c.cfg.KeyConcurrency.Key)
+		if err != nil {
+			return fmt.Errorf("invalid key_concurrency key: %w", err)
+		}
+		if key == nil || c.cfg.KeyConcurrency.Limit < 1 {
+			return fmt.Errorf("key_concurrency requires key and a positive limit")
+		}
+		c.keys = append(c.keys, key)
+		c.keyLimits = append(c.keyLimits, c.cfg.KeyConcurrency.Limit)
+	}
+
+	if c.cfg.Batch != nil && len(c.keys) > 0 {
+		return fmt.Errorf("batch can't be combined with ordering_key or key_concurrency")
+	}
+
+	options := []amqp.ConsumeOption{
+		amqp.WithStateNotify(c.stateChanged),
+		amqp.WithSingleActive(c.singleActive),
+	}
+
+	if c.cfg.Stream != nil {
+		store, err := newOffsetStore(c.cfg.Stream, client)
+		if err != nil {
+			return err
+		}
+
+		c.offsets = newOffsetTracker(c.cfg.Stream, store, c.log)
+		err = c.offsets.load()
+		if err != nil {
+			return err
+		}
+
+		args := c.cfg.ConsumeArgs()
+		options = append(options, amqp.WithArgsFunc(func(resumed bool) amqp.Table {
+			return c.offsets.args(args, resumed)
+		}))
+	}
+
+	c.amqp = client.NewConsumer(
+		c.cfg.Queue,
+		c.cfg.ConsumerID,
+		c.cfg.AutoAck,
+		c.cfg.Exclusive,
+		c.cfg.NoLocal,
+		false,
+		c.cfg.ConsumeArgs(),
+		c.cfg.Prefetch,
+		options...,
+	)
+
+	err = c.amqp.Consume()
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// stop flushes the stream offset, the consumer is not rescaled afterward
+func (c *consumer) stop() {
+	c.stopped.Store(true)
+
+	if c.offsets != nil {
+		c.offsets.stop()
+	}
+}
+
+func (c *consumer) message(delivery *amqp.Delivery) *message {
+	msg := &message{
+		delivery: delivery,
+		consumer: c.cfg,
+		finished: func() {
+			c.finished.Add(1)
+		},
+	}
+
+	if len(c.keys) > 0 {
+		msg.keys = make([]string, len(c.keys))
+		for i, key := range c.keys {
+			msg.keys[i] = key(delivery)
+		}
+	}
+
+	if c.offsets != nil {
+		if offset, ok := streamOffset(delivery); ok {
+			c.offsets.begin(offset)
+			msg.processed = func() {
+				c.offsets.done(offset)
+			}
+		}
+	}
+
+	return msg
+}
+
+const (
+	ConsumerRunning = "running"
+	ConsumerPaused  = "paused"
+	ConsumerDrained = "drained"
+)
+
+func (c *consumer) pause() error {
+	err := c.amqp.Pause()
+	if err != nil {
+		return err
+	}
+
+	c.log.Info("consumer paused", zap.String("queue", c.cfg.Queue), zap.String("consumer", c.amqp.Tag()))
+	return nil
+}
+
+func (c *consumer) resume() error {
+	err := c.amqp.Resume()
+	if err != nil {
+		return err
+	}
+
+	c.log.Info("consumer resumed", zap.String("queue", c.cfg.Queue), zap.String("consumer", c.amqp.Tag()))
+	return nil
+}
+
+// drain pauses the consumer and waits until the worker is done with all its messages
+func (c *consumer) drain(ctx context.Context) error {
+	err := c.pause()
+	if err != nil {
+		return err
+	}
+
+	err = c.amqp.WaitCancelled(ctx)
+	if err != nil {
+		return err
+	}
+
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+
+	for c.inFlight() > 0 {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	return nil
+}
+
+func (c *consumer) inFlight() int {
+	return int(c.amqp.Delivered() - c.finished.Load())
+}
+
+func (c *consumer) state() string {
+	if !c.amqp.Paused() {
+		return ConsumerRunning
+	}
+
+	if !c.amqp.Forwarding() && c.inFlight() == 0 {
+		return ConsumerDrained
+	}
+
+	return ConsumerPaused
+}
+
+func (c *consumer) stateChanged(state amqp.ConsumerState) {
+	switch state {
+	case amqp.StateActive:
+		c.log.Info("consumer is active", zap.String("queue", c.cfg.Queue), zap.String("consumer", c.amqp.Tag()))
+	case amqp.StateStandby:
+		c.log.Info("consumer is on standby", zap.String("queue", c.cfg.Queue), zap.String("consumer", c.amqp.Tag()))
+	default:
+		c.log.Debug("consumer state is unknown", zap.String("queue", c.cfg.Queue), zap.String("consumer", c.amqp.Tag()))
+	}
+
+	go c.rescale()
+}
+
+// rescale removes the consumer's share of workers from the pool while it's on standby and returns them once it's active.
+// Nothing changes while the state is unknown.
+func (c *consumer) rescale() {
+	if !c.cfg.StandbyScaleDown || c.cfg.Concurrency == 0 {
+		return
+	}
+
+	c.scaleMu.Lock()
+	defer c.scaleMu.Unlock()
+
+	if c.stopped.Load() {
+		return
+	}
+
+	state, _ := c.amqp.State()
+
+	switch state {
+	case amqp.StateActive:
+		c.restoreWorkersLocked()
+		return
+	case amqp.StateUnknown:
+		return
+	}
+
+	for int(c.scaledDown.Load()) < c.cfg.Concurrency {
+		before := len(c.pool.Workers())
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+		err := c.pool.RemoveWorker(ctx)
+		cancel()
+		if err != nil {
+			c.log.Error("failed to remove worker", zap.String("queue", c.cfg.Queue), zap.Error(err))
+			return
+		}
+
+		// the pool keeps its last worker
+		if len(c.pool.Workers()) >= before {
+			return
+		}
+		c.scaledDown.Add(1)
+	}
+}
+
+// restoreWorkers returns workers removed while on standby to the pool
+func (c *consumer) restoreWorkers() {
+	c.scaleMu.Lock()
+	defer c.scaleMu.Unlock()
+
+	c.restoreWorkersLocked()
+}
+
+func (c *consumer) restoreWorkersLocked() {
+	for c.scaledDown.Load() > 0 {
+		err := c.pool.AddWorker()
+		if err != nil {
+			c.log.Error("failed to add worker", zap.String("queue", c.cfg.Queue), zap.Error(err))
+			return
+		}
+		c.scaledDown.Add(-1)
+	}
+}
+
+func (c *consumer) status() *ConsumerStatus {
+	state, since := c.amqp.State()
+
+	status := &ConsumerStatus{
+		Queue:      c.cfg.Queue,
+		ConsumerID: c.amqp.Tag(),
+		Active:     state == amqp.StateActive,
+		Standby:    state == amqp.StateStandby,
+		ScaledDown: int(c.scaledDown.Load()),
+		State:      c.state(),
+		InFlight:   c.inFlight(),
+		Dynamic:    c.definition != nil,
+	}
+	if c.held != nil {
+		status.Held = c.held()
+	}
+	if !since.IsZero() {
+		status.Since = since.Format(time.RFC3339)
+	}
+
+	return status
+}
@@ -0,0 +1,83 @@
+package thumper
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/go-viper/mapstructure/v2"
+	"os"
+	"path/filepath"
+)
+
+// decodeConsumerConfig decodes and validates a consumer definition with the same rules as the config file
+func decodeConsumerConfig(definition map[string]any) (*ConsumerConfig, error) {
+	cfg := new(ConsumerConfig)
+
+	decoder, err := mapstructure.NewDecoder(&mapstructure.DecoderConfig{
+		Result:           cfg,
+		WeaklyTypedInput: true,
+		DecodeHook: mapstructure.ComposeDecodeHookFunc(
+			mapstructure.StringToTimeDurationHookFunc(),
+			mapstructure.StringToSliceHookFunc(","),
+		),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	err = decoder.Decode(definition)
+	if err != nil {
+		return nil, fmt.Errorf("invalid consumer definition: %w", err)
+	}
+
+	// definitions come from RPC callers, expanding environment variables would expose them through ListConsumers
+	cfg.InitDefaults()
+
+	// the queue may be declared at runtime, it's not checked against the config
+	v := &validator{}
+	cfg.validate(v, "consumer", nil)
+	if len(v.problems) > 0 {
+		return nil, fmt.Errorf("invalid consumer definition: %w", &configError{problems: v.problems})
+	}
+
+	return cfg, nil
+}
+
+// loadDynamicConsumers reads consumer definitions persisted by saveDynamicConsumers
+func loadDynamicConsumers(path string) ([]map[string]any, error) {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var definitions []map[string]any
+	err = json.Unmarshal(data, &definitions)
+	if err != nil {
+		return nil, fmt.Errorf("malformed dynamic consumers file %s: %w", path, err)
+	}
+
+	return definitions, nil
+}
+
+func saveDynamicConsumers(path string, definitions []map[string]any) error {
+	data, err := json.MarshalIndent(definitions, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(filepath.Dir(path), 0o755)
+	if err != nil {
+		return err
+	}
+
+	// write and rename, so the file is never left half written
+	tmp := path + ".tmp"
+	err = os.WriteFile(tmp, data, 0o644)
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, path)
+}
@@ -0,0 +1,54 @@
+package thumper
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestDecodeConsumerConfig(t *testing.T) {
+	tests := []struct {
+		name       string
+		definition map[string]any
+		err        string
+	}{
+		{name: "valid", definition: map[string]any{"queue": "orders", "prefetch": "5", "exec_timeout": "10s"}},
+		{name: "undeclared queue", definition: map[string]any{"queue": "tenant-42"}},
+		{name: "queue required", definition: map[string]any{"prefetch": 5}, err: "consumer.queue: is required"},
+		{name: "negative prefetch", definition: map[string]any{"queue": "orders", "prefetch": -1}, err: "consumer.prefetch: must not be negative"},
+		{name: "bad ordering key", definition: map[string]any{"queue": "orders", "ordering_key": "cookie:id"}, err: "consumer.ordering_key"},
+		{name: "malformed", definition: map[string]any{"queue": "orders", "prefetch": "many"}, err: "invalid consumer definition"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, err := decodeConsumerConfig(tt.definition)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("error %v, expected %q", err, tt.err)
+				}
+				if strings.Contains(err.Error(), pluginName+".") {
+					t.Errorf("error %q refers to the config file", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if cfg.RequeueOnFail == nil {
+				t.Error("defaults are not set")
+			}
+		})
+	}
+}
+
+func TestDecodeConsumerConfigKeepsEnv(t *testing.T) {
+	t.Setenv("THUMPER_TEST_SECRET", "secret")
+
+	cfg, err := decodeConsumerConfig(map[string]any{"queue": "${THUMPER_TEST_SECRET}", "consumer_id": "$THUMPER_TEST_SECRET"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Queue != "${THUMPER_TEST_SECRET}" || cfg.ConsumerID != "$THUMPER_TEST_SECRET" {
+		t.Errorf("queue %s and consumer id %s, expected the environment variables not to be expanded", cfg.Queue, cfg.ConsumerID)
+	}
+}
@@ -0,0 +1,117 @@
+package thumper
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/dstrop/thumper/amqp"
+	"strconv"
+	"strings"
+)
+
+// keyExtractor returns the key of the delivery, an empty key when the delivery has none
+type keyExtractor func(delivery *amqp.Delivery) string
+
+// parseKeyExtractor parses a key definition:
+// header:<name> (or just <name>), routing_key for the whole routing key,
+// routing_key:<n> for its n-th dot separated segment (from 0) or body:<path> for a JSON path in the body, e.g. body:order.id
+func parseKeyExtractor(spec string) (keyExtractor, error) {
+	if spec == "" {
+		return nil, nil
+	}
+
+	source, arg, found := strings.Cut(spec, ":")
+	if !found {
+		if spec == "routing_key" {
+			return func(delivery *amqp.Delivery) string {
+				return delivery.RoutingKey
+			}, nil
+		}
+		source, arg = "header", spec
+	}
+
+	switch source {
+	case "header":
+		if arg == "" {
+			return nil, fmt.Errorf("key %s: missing header name", spec)
+		}
+		return func(delivery *amqp.Delivery) string {
+			return headerKey(delivery.Headers[arg])
+		}, nil
+	case "routing_key":
+		segment, err := strconv.Atoi(arg)
+		if err != nil || segment < 0 {
+			return nil, fmt.Errorf("key %s: invalid routing key segment %s", spec, arg)
+		}
+		return func(delivery *amqp.Delivery) string {
+			segments := strings.Split(delivery.RoutingKey, ".")
+			if segment >= len(segments) {
+				return ""
+			}
+			return segments[segment]
+		}, nil
+	case "body":
+		path := strings.TrimPrefix(strings.TrimPrefix(arg, "$"), ".")
+		if path == "" {
+			return nil, fmt.Errorf("key %s: missing JSON path", spec)
+		}
+		return func(delivery *amqp.Delivery) string {
+			return bodyKey(delivery.Body, strings.Split(path, "."))
+		}, nil
+	default:
+		return nil, fmt.Errorf("key %s: unknown source %s, expected header, routing_key or body", spec, source)
+	}
+}
+
+func headerKey(value any) string {
+	switch value := value.(type) {
+	case nil:
+		return ""
+	case string:
+		return value
+	case []byte:
+		return string(value)
+	default:
+		return fmt.Sprint(value)
+	}
+}
+
+// bodyKey looks up the path in the JSON body, objects are traversed by key and arrays by index
+func bodyKey(body []byte, path []string) string {
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.UseNumber()
+
+	var value any
+	if decoder.Decode(&value) != nil {
+		return ""
+	}
+
+	for _, segment := range path {
+		switch node := value.(type) {
+		case map[string]any:
+			value = node[segment]
+		case []any:
+			index, err := strconv.Atoi(segment)
+			if err != nil || index < 0 || index >= len(node) {
+				return ""
+			}
+			value = node[index]
+		default:
+			return ""
+		}
+	}
+
+	switch value := value.(type) {
+	case nil:
+		return ""
+	case string:
+		return value
+	case json.Number:
+		return value.String()
+	case bool:
+		return strconv.FormatBool(value)
+	default:
+		key, _ := json.Marshal(value)
+		return string(key)
+	}
+}
@@ -0,0 +1,168 @@
+package thumper
+
+import (
+	"github.com/dstrop/thumper/amqp"
+	amqp091 "github.com/rabbitmq/amqp091-go"
+	"slices"
+	"strconv"
+	"testing"
+)
+
+func TestParseKeyExtractor(t *testing.T) {
+	delivery := &amqp.Delivery{Delivery: amqp091.Delivery{
+		RoutingKey: "orders.eu.created",
+		Headers: amqp091.Table{
+			"x-order-id": "order-42",
+			"x-tenant":   []byte("acme"),
+			"x-shard":    int32(7),
+		},
+		Body: []byte(`{"order":{"id":42,"paid":true,"items":[{"sku":"abc"}],"tags":["a","b"]}}`),
+	}}
+
+	tests := []struct {
+		spec string
+		want string
+	}{
+		{"x-order-id", "order-42"},
+		{"header:x-order-id", "order-42"},
+		{"header:x-tenant", "acme"},
+		{"header:x-shard", "7"},
+		{"header:x-missing", ""},
+		{"routing_key", "orders.eu.created"},
+		{"routing_key:0", "orders"},
+		{"routing_key:2", "created"},
+		{"routing_key:3", ""},
+		{"body:order.id", "42"},
+		{"body:$.order.id", "42"},
+		{"body:order.paid", "true"},
+		{"body:order.items.0.sku", "abc"},
+		{"body:order.items.1.sku", ""},
+		{"body:order.tags", `["a","b"]`},
+		{"body:order.missing", ""},
+	}
+
+	for _, tt := range tests {
+		key, err := parseKeyExtractor(tt.spec)
+		if err != nil {
+			t.Errorf("%s: %v", tt.spec, err)
+			continue
+		}
+		if got := key(delivery); got != tt.want {
+			t.Errorf("%s: got %q, expected %q", tt.spec, got, tt.want)
+		}
+	}
+}
+
+func TestParseKeyExtractorInvalid(t *testing.T) {
+	for _, spec := range []string{"header:", "routing_key:x", "routing_key:-1", "body:", "body:$", "payload:id"} {
+		_, err := parseKeyExtractor(spec)
+		if err == nil {
+			t.Errorf("%s: expected an error", spec)
+		}
+	}
+
+	key, err := parseKeyExtractor("")
+	if key != nil || err != nil {
+		t.Errorf("an empty spec should disable the key")
+	}
+}
+
+func TestBodyKeyInvalidJSON(t *testing.T) {
+	if got := bodyKey([]byte("not json"), []string{"id"}); got != "" {
+		t.Errorf("got %q, expected no key", got)
+	}
+}
+
+func TestSchedulerOrderingKey(t *testing.T) {
+	s := newScheduler()
+	l := s.addLane(1, 0, 10, newKeyLimiter(1))
+	s.push(l, testMessage("a0", "a"))
+	s.push(l, testMessage("a1", "a"))
+	s.push(l, testMessage("b0", "b"))
+	s.push(l, testMessage("x0", ""))
+	s.push(l, testMessage("a2", "a"))
+
+	if got := dispatch(s); !slices.Equal(got, []string{"a0", "b0", "x0"}) {
+		t.Fatalf("dispatched %v, expected [a0 b0 x0]", got)
+	}
+	if held := s.held(l); held != 2 {
+		t.Errorf("%d messages held, expected 2", held)
+	}
+
+	msg := testMessage("a0", "a")
+	msg.lane = l
+	s.done(msg)
+	if got := dispatch(s); !slices.Equal(got, []string{"a1"}) {
+		t.Fatalf("dispatched %v, expected [a1]", got)
+	}
+
+	s.done(msg)
+	if got := dispatch(s); !slices.Equal(got, []string{"a2"}) {
+		t.Errorf("dispatched %v, expected [a2]", got)
+	}
+}
+
+func TestSchedulerKeyConcurrency(t *testing.T) {
+	tests := []struct {
+		name  string
+		limit int
+		keys  []string
+		want  []string
+		held  int
+		next  []string
+	}{
+		{name: "limit 2", limit: 2, keys: []string{"a", "a", "a", "b"}, want: []string{"m0", "m1", "m3"}, held: 1, next: []string{"m2"}},
+		{name: "limit 1", limit: 1, keys: []string{"a", "b", "a", "b"}, want: []string{"m0", "m1"}, held: 2, next: []string{"m2"}},
+		{name: "no key", limit: 1, keys: []string{"", "", "a"}, want: []string{"m0", "m1", "m2"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newScheduler()
+			l := s.addLane(1, 0, 10, newKeyLimiter(tt.limit))
+			for i, key := range tt.keys {
+				s.push(l, testMessage("m"+strconv.Itoa(i), key))
+			}
+
+			if got := dispatch(s); !slices.Equal(got, tt.want) {
+				t.Fatalf("dispatched %v, expected %v", got, tt.want)
+			}
+			if held := s.held(l); held != tt.held {
+				t.Errorf("%d messages held, expected %d", held, tt.held)
+			}
+
+			msg := testMessage("m0", tt.keys[0])
+			msg.lane = l
+			s.done(msg)
+			if got := dispatch(s); !slices.Equal(got, tt.next) {
+				t.Errorf("dispatched %v after m0, expected %v", got, tt.next)
+			}
+		})
+	}
+}
+
+// ordering_key and key_concurrency combined, a message needs both of its keys below the limits
+func TestSchedulerCombinedLimiters(t *testing.T) {
+	s := newScheduler()
+	tenants := newKeyLimiter(2)
+	l := s.addLane(1, 0, 10, newKeyLimiter(1), tenants)
+	s.push(l, testMessage("m0", "order-1", "acme"))
+	s.push(l, testMessage("m1", "order-1", "acme"))
+	s.push(l, testMessage("m2", "order-2", "acme"))
+	s.push(l, testMessage("m3", "order-3", "acme"))
+	s.push(l, testMessage("m4", "order-4", "globex"))
+
+	if got := dispatch(s); !slices.Equal(got, []string{"m0", "m2", "m4"}) {
+		t.Fatalf("dispatched %v, expected [m0 m2 m4]", got)
+	}
+	if tenants.inFlight["acme"] != 2 || tenants.inFlight["globex"] != 1 {
+		t.Errorf("unexpected in-flight tenants %v", tenants.inFlight)
+	}
+
+	msg := testMessage("m2", "order-2", "acme")
+	msg.lane = l
+	s.done(msg)
+	if got := dispatch(s); !slices.Equal(got, []string{"m3"}) {
+		t.Errorf("dispatched %v, expected [m3]", got)
+	}
+}
@@ -0,0 +1,123 @@
+package thumper
+
+import (
+	"crypto/rand"
+	"fmt"
+	"github.com/dstrop/thumper/amqp"
+	"sync"
+)
+
+// maxBodyChunk caps the chunks of large bodies read by the workers
+const maxBodyChunk = 16 << 20
+
+// bodyStore holds large bodies while the workers read them in chunks over RPC,
+// so a worker never has the whole body in memory
+type bodyStore struct {
+	mu     sync.Mutex
+	bodies map[string][]byte
+}
+
+func newBodyStore() *bodyStore {
+	return &bodyStore{bodies: make(map[string][]byte)}
+}
+
+// hold keeps a body larger than the threshold in the store instead of the payload.
+// The returned release removes it once the worker responds.
+func (s *bodyStore) hold(msg *message) func() {
+	cfg := msg.consumer.LargeBody
+	if cfg == nil || len(msg.body) <= cfg.Threshold {
+		return func() {}
+	}
+
+	id := rand.Text()
+
+	s.mu.Lock()
+	s.bodies[id] = msg.body
+	s.mu.Unlock()
+
+	msg.bodyID, msg.bodySize = id, len(msg.body)
+	msg.body = nil
+
+	return func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+
+		delete(s.bodies, id)
+	}
+}
+
+// read returns up to size bytes of the body from offset, an empty chunk at the end of the body
+func (s *bodyStore) read(id string, offset int64, size int) ([]byte, error) {
+	s.mu.Lock()
+	body, ok := s.bodies[id]
+	s.mu.Unlock()
+
+	if !ok {
+		return nil, fmt.Errorf("body %s not found, it's readable only until the worker responds", id)
+	}
+	if offset < 0 || offset > int64(len(body)) {
+		return nil, fmt.Errorf("offset %d out of the body of %d bytes", offset, len(body))
+	}
+	if size <= 0 || size > maxBodyChunk {
+		size = maxBodyChunk
+	}
+
+	end := min(offset+int64(size), int64(len(body)))
+
+	return body[offset:end], nil
+}
+
+// replyStream publishes the chunks streamed by the worker to the reply_to queue of the message as they arrive.
+// Each chunk is published as a message with the x-thumper-chunk sequence number, the last one with x-thumper-last,
+// so a chunk is held until the next one or the result arrives.
+type replyStream struct {
+	client   publisher
+	delivery *amqp.Delivery
+
+	held []byte
+	seq  int64
+	// discarded is set when the message has no reply_to
+	discarded bool
+}
+
+func (r *replyStream) write(chunk []byte) error {
+	if r.delivery.ReplyTo == "" {
+		r.discarded = true
+		return nil
+	}
+
+	if r.held != nil {
+		err := r.publish(false)
+		if err != nil {
+			return err
+		}
+	}
+	r.held = chunk
+
+	return nil
+}
+
+// close publishes the held chunk as the last one
+func (r *replyStream) close() error {
+	if r.held == nil {
+		return nil
+	}
+
+	return r.publish(true)
+}
+
+func (r *replyStream) publish(last bool) error {
+	headers := amqp.Table{"x-thumper-chunk": r.seq}
+	if last {
+		headers["x-thumper-last"] = true
+	}
+
+	err := r.client.Reply(r.delivery, r.held, headers)
+	if err != nil {
+		return fmt.Errorf("failed to publish reply chunk %d: %w", r.seq, err)
+	}
+	r.seq++
+	r.held = nil
+
+	return nil
+}
@@ -0,0 +1,101 @@
+package thumper
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestBodyStoreHold(t *testing.T) {
+	tests := []struct {
+		name      string
+		largeBody *LargeBodyConfig
+		size      int
+		held      bool
+	}{
+		{name: "disabled", size: 100},
+		{name: "below threshold", largeBody: &LargeBodyConfig{Threshold: 100}, size: 100},
+		{name: "above threshold", largeBody: &LargeBodyConfig{Threshold: 100}, size: 101, held: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := newBodyStore()
+			body := bytes.Repeat([]byte{'x'}, tt.size)
+			msg := &message{consumer: &ConsumerConfig{LargeBody: tt.largeBody}, body: body}
+
+			release := store.hold(msg)
+			if held := msg.bodyID != ""; held != tt.held {
+				t.Fatalf("held %t, expected %t", held, tt.held)
+			}
+			if !tt.held {
+				if !bytes.Equal(msg.body, body) {
+					t.Error("body was removed from the payload")
+				}
+				return
+			}
+
+			if msg.body != nil || msg.bodySize != tt.size {
+				t.Errorf("body of %d bytes in the payload, size %d", len(msg.body), msg.bodySize)
+			}
+
+			release()
+			_, err := store.read(msg.bodyID, 0, 10)
+			if err == nil {
+				t.Error("released body is still readable")
+			}
+		})
+	}
+}
+
+func TestBodyStoreRead(t *testing.T) {
+	store := newBodyStore()
+	body := []byte("0123456789")
+	msg := &message{consumer: &ConsumerConfig{LargeBody: &LargeBodyConfig{Threshold: 1}}, body: body}
+	defer store.hold(msg)()
+
+	tests := []struct {
+		offset  int64
+		size    int
+		want    string
+		wantErr bool
+	}{
+		{offset: 0, size: 4, want: "0123"},
+		{offset: 4, size: 4, want: "4567"},
+		{offset: 8, size: 4, want: "89"},
+		{offset: 10, size: 4, want: ""},
+		{offset: 0, size: 0, want: "0123456789"},
+		{offset: 11, size: 4, wantErr: true},
+		{offset: -1, size: 4, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		got, err := store.read(msg.bodyID, tt.offset, tt.size)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("read(%d, %d): unexpected error %v", tt.offset, tt.size, err)
+			continue
+		}
+		if string(got) != tt.want {
+			t.Errorf("read(%d, %d) = %q, expected %q", tt.offset, tt.size, got, tt.want)
+		}
+	}
+
+	_, err := store.read("unknown", 0, 4)
+	if err == nil {
+		t.Error("expected an error for an unknown body")
+	}
+}
+
+func TestReplyStreamWithoutReplyTo(t *testing.T) {
+	reply := &replyStream{delivery: testMessage("m0").delivery}
+
+	err := reply.write([]byte("chunk"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reply.discarded {
+		t.Error("expected the chunk to be discarded")
+	}
+	if err = reply.close(); err != nil {
+		t.Error(err)
+	}
+}
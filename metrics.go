@@ -0,0 +1,236 @@
+package thumper
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"time"
+)
+
+const namespace = "thumper"
+
+// metrics implements amqp.Observer, its methods can be called on nil
+type metrics struct {
+	received *prometheus.CounterVec
+	acked    *prometheus.CounterVec
+	nacked   *prometheus.CounterVec
+	rejected *prometheus.CounterVec
+	execTime *prometheus.HistogramVec
+
+	published      *prometheus.CounterVec
+	publishFailed  *prometheus.CounterVec
+	returned       *prometheus.CounterVec
+	confirmLatency prometheus.Histogram
+	reconnects     prometheus.Counter
+
+	state *stateCollector
+}
+
+func newMetrics(p *Plugin) *metrics {
+	return &metrics{
+		received: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "deliveries_received_total",
+			Help:      "Deliveries received from the broker.",
+		}, []string{"queue"}),
+		acked: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "deliveries_acked_total",
+			Help:      "Deliveries acked.",
+		}, []string{"queue"}),
+		nacked: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "deliveries_nacked_total",
+			Help:      "Deliveries nacked, requeued or not.",
+		}, []string{"queue"}),
+		rejected: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "deliveries_rejected_total",
+			Help:      "Deliveries rejected.",
+		}, []string{"queue"}),
+		execTime: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "exec_duration_seconds",
+			Help:      "Duration of worker executions, a batch is a single execution.",
+			Buckets:   prometheus.ExponentialBuckets(0.001, 4, 10),
+		}, []string{"queue"}),
+		published: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "published_total",
+			Help:      "Messages published and confirmed by the broker.",
+		}, []string{"exchange"}),
+		publishFailed: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "publish_failed_total",
+			Help:      "Publishes nacked by the broker, not confirmed in time or failed.",
+		}, []string{"exchange"}),
+		returned: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "published_returned_total",
+			Help:      "Unroutable mandatory publishes returned by the broker.",
+		}, []string{"exchange"}),
+		confirmLatency: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "publish_confirm_seconds",
+			Help:      "Time between a publish and its confirmation.",
+			Buckets:   prometheus.ExponentialBuckets(0.0005, 4, 10),
+		}),
+		reconnects: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "reconnects_total",
+			Help:      "Connections reestablished after the connection was lost.",
+		}),
+		state: newStateCollector(p),
+	}
+}
+
+func (m *metrics) collectors() []prometheus.Collector {
+	return []prometheus.Collector{
+		m.received,
+		m.acked,
+		m.nacked,
+		m.rejected,
+		m.execTime,
+		m.published,
+		m.publishFailed,
+		m.returned,
+		m.confirmLatency,
+		m.reconnects,
+		m.state,
+	}
+}
+
+func (m *metrics) delivered(queue string, count int) {
+	if m == nil {
+		return
+	}
+	m.received.WithLabelValues(queue).Add(float64(count))
+}
+
+// settled counts deliveries settled with the worker response code
+func (m *metrics) settled(queue string, result byte, count int) {
+	if m == nil {
+		return
+	}
+
+	switch result {
+	case Ack:
+		m.acked.WithLabelValues(queue).Add(float64(count))
+	case Nack:
+		m.nacked.WithLabelValues(queue).Add(float64(count))
+	case Reject:
+		m.rejected.WithLabelValues(queue).Add(float64(count))
+	}
+}
+
+func (m *metrics) executed(queue string, duration time.Duration) {
+	if m == nil {
+		return
+	}
+	m.execTime.WithLabelValues(queue).Observe(duration.Seconds())
+}
+
+func (m *metrics) Published(exchange string, confirmLatency time.Duration, err error) {
+	if m == nil {
+		return
+	}
+
+	if err != nil {
+		m.publishFailed.WithLabelValues(exchange).Inc()
+		return
+	}
+
+	m.published.WithLabelValues(exchange).Inc()
+	m.confirmLatency.Observe(confirmLatency.Seconds())
+}
+
+func (m *metrics) Returned(exchange, _ string) {
+	if m == nil {
+		return
+	}
+	m.returned.WithLabelValues(exchange).Inc()
+}
+
+func (m *metrics) Reconnected() {
+	if m == nil {
+		return
+	}
+	m.reconnects.Inc()
+}
+
+// stateCollector reports the current state of the plugin on scrape
+type stateCollector struct {
+	plugin *Plugin
+
+	inFlight     *prometheus.Desc
+	held         *prometheus.Desc
+	channelUp    *prometheus.Desc
+	connectionUp *prometheus.Desc
+	idleChannels *prometheus.Desc
+	workers      *prometheus.Desc
+}
+
+func newStateCollector(p *Plugin) *stateCollector {
+	return &stateCollector{
+		plugin: p,
+		inFlight: prometheus.NewDesc(namespace+"_in_flight",
+			"Deliveries received and not settled yet.", []string{"queue", "consumer"}, nil),
+		held: prometheus.NewDesc(namespace+"_held",
+			"Deliveries waiting for their key to be below the key limit.", []string{"queue", "consumer"}, nil),
+		channelUp: prometheus.NewDesc(namespace+"_consumer_channel_up",
+			"Whether the consumer channel is open.", []string{"queue", "consumer"}, nil),
+		connectionUp: prometheus.NewDesc(namespace+"_connection_up",
+			"Whether the connection is open.", nil, nil),
+		idleChannels: prometheus.NewDesc(namespace+"_channel_pool_size",
+			"Idle publishing channels in the pool.", nil, nil),
+		workers: prometheus.NewDesc(namespace+"_workers",
+			"Workers by pool and state.", []string{"pool", "state"}, nil),
+	}
+}
+
+func (c *stateCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.inFlight
+	ch <- c.held
+	ch <- c.channelUp
+	ch <- c.connectionUp
+	ch <- c.idleChannels
+	ch <- c.workers
+}
+
+func (c *stateCollector) Collect(ch chan<- prometheus.Metric) {
+	state := c.plugin.snapshot()
+
+	for _, consumer := range state.consumers {
+		queue, tag := consumer.cfg.Queue, consumer.amqp.Tag()
+
+		ch <- prometheus.MustNewConstMetric(c.inFlight, prometheus.GaugeValue, float64(consumer.inFlight()), queue, tag)
+		if consumer.held != nil {
+			ch <- prometheus.MustNewConstMetric(c.held, prometheus.GaugeValue, float64(consumer.held()), queue, tag)
+		}
+		ch <- prometheus.MustNewConstMetric(c.channelUp, prometheus.GaugeValue, boolValue(consumer.amqp.ChannelOpen()), queue, tag)
+	}
+
+	if state.client != nil {
+		ch <- prometheus.MustNewConstMetric(c.connectionUp, prometheus.GaugeValue, boolValue(state.client.Connected()))
+		ch <- prometheus.MustNewConstMetric(c.idleChannels, prometheus.GaugeValue, float64(state.client.IdleChannels()))
+	}
+
+	for name, wp := range state.pools {
+		if name == "" {
+			name = "default"
+		}
+
+		states := make(map[string]int)
+		for _, process := range wp.pool.Workers() {
+			states[process.State().String()]++
+		}
+		for state, count := range states {
+			ch <- prometheus.MustNewConstMetric(c.workers, prometheus.GaugeValue, float64(count), name, state)
+		}
+	}
+}
+
+func boolValue(value bool) float64 {
+	if value {
+		return 1
+	}
+	return 0
+}
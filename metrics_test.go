@@ -0,0 +1,115 @@
+package thumper
+
+import (
+	"errors"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/roadrunner-server/pool/fsm"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMetricsCounters(t *testing.T) {
+	m := newMetrics(&Plugin{})
+
+	m.delivered("orders", 3)
+	m.settled("orders", Ack, 2)
+	m.settled("orders", Nack, 1)
+	m.settled("orders", Reject, 1)
+	m.Published("orders", time.Millisecond, nil)
+	m.Published("orders", 0, errors.New("nacked"))
+	m.Returned("orders", "orders.created")
+	m.Reconnected()
+
+	tests := []struct {
+		name  string
+		value float64
+		want  float64
+	}{
+		{name: "received", value: testutil.ToFloat64(m.received.WithLabelValues("orders")), want: 3},
+		{name: "acked", value: testutil.ToFloat64(m.acked.WithLabelValues("orders")), want: 2},
+		{name: "nacked", value: testutil.ToFloat64(m.nacked.WithLabelValues("orders")), want: 1},
+		{name: "rejected", value: testutil.ToFloat64(m.rejected.WithLabelValues("orders")), want: 1},
+		{name: "published", value: testutil.ToFloat64(m.published.WithLabelValues("orders")), want: 1},
+		{name: "publish failed", value: testutil.ToFloat64(m.publishFailed.WithLabelValues("orders")), want: 1},
+		{name: "returned", value: testutil.ToFloat64(m.returned.WithLabelValues("orders")), want: 1},
+		{name: "reconnects", value: testutil.ToFloat64(m.reconnects), want: 1},
+	}
+
+	for _, tt := range tests {
+		if tt.value != tt.want {
+			t.Errorf("%s %v, expected %v", tt.name, tt.value, tt.want)
+		}
+	}
+
+	if count := testutil.CollectAndCount(m.confirmLatency); count != 1 {
+		t.Errorf("%d confirm latency histograms, expected 1", count)
+	}
+}
+
+func TestMetricsNil(t *testing.T) {
+	var m *metrics
+
+	m.delivered("orders", 1)
+	m.settled("orders", Ack, 1)
+	m.executed("orders", time.Second)
+	m.Published("orders", time.Millisecond, nil)
+	m.Returned("orders", "orders.created")
+	m.Reconnected()
+}
+
+func TestStateCollector(t *testing.T) {
+	held := &consumer{
+		cfg:  &ConsumerConfig{Queue: "orders"},
+		amqp: &testConsumer{tag: "orders-1", delivered: 5, channelOpen: true},
+		held: func() int { return 2 },
+	}
+	held.finished.Store(3)
+
+	state := &pluginState{
+		client: &testConnection{connected: true, idle: 4},
+		pools: map[string]*Worker{
+			"":        {pool: testPoolWorkers(t, fsm.StateReady, fsm.StateReady, fsm.StateWorking)},
+			"reports": {pool: testPoolWorkers(t, fsm.StateInactive)},
+		},
+	}
+	p := testPlugin(state, held, testConsumerOf("payments", &testConsumer{tag: "payments-1"}))
+
+	expected := `
+# HELP thumper_channel_pool_size Idle publishing channels in the pool.
+# TYPE thumper_channel_pool_size gauge
+thumper_channel_pool_size 4
+# HELP thumper_connection_up Whether the connection is open.
+# TYPE thumper_connection_up gauge
+thumper_connection_up 1
+# HELP thumper_consumer_channel_up Whether the consumer channel is open.
+# TYPE thumper_consumer_channel_up gauge
+thumper_consumer_channel_up{consumer="orders-1",queue="orders"} 1
+thumper_consumer_channel_up{consumer="payments-1",queue="payments"} 0
+# HELP thumper_held Deliveries waiting for their key to be below the key limit.
+# TYPE thumper_held gauge
+thumper_held{consumer="orders-1",queue="orders"} 2
+# HELP thumper_in_flight Deliveries received and not settled yet.
+# TYPE thumper_in_flight gauge
+thumper_in_flight{consumer="orders-1",queue="orders"} 2
+thumper_in_flight{consumer="payments-1",queue="payments"} 0
+# HELP thumper_workers Workers by pool and state.
+# TYPE thumper_workers gauge
+thumper_workers{pool="default",state="ready"} 2
+thumper_workers{pool="default",state="working"} 1
+thumper_workers{pool="reports",state="inactive"} 1
+`
+
+	err := testutil.CollectAndCompare(newStateCollector(p), strings.NewReader(expected))
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestStateCollectorNotConnected(t *testing.T) {
+	p := testPlugin(&pluginState{})
+
+	if count := testutil.CollectAndCount(newStateCollector(p)); count != 0 {
+		t.Errorf("%d metrics before the plugin runs, expected none", count)
+	}
+}
@@ -5,10 +5,15 @@ import (
 	"fmt"
 	"github.com/dstrop/thumper/amqp"
 	"github.com/dstrop/thumper/common"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/roadrunner-server/errors"
+	"github.com/roadrunner-server/pool/pool"
 	"github.com/roadrunner-server/pool/state/process"
 	"go.uber.org/zap"
+	"strconv"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 const pluginName string = "thumper"
@@ -19,16 +24,28 @@ type Plugin struct {
 	server common.Server
 
 	mu sync.RWMutex
+	// resetMu serializes resets
+	resetMu sync.Mutex
 
-	pool common.Pool
+	// pools are the worker pools by name, the default pool has an empty name
+	pools map[string]*Worker
 
 	// TODO: add support for multiple clients
-	client *amqp.Client
-	wp     *Worker
+	client    *amqp.Client
+	consumers []*consumer
 
-	// TODO: add metrics exporter
-	//statsExporter *metrics.StatsExporter
-	// TODO: implement status.Readiness and status.Checker
+	metrics *metrics
+	// bodies holds large bodies while the workers read them
+	bodies *bodyStore
+
+	// declared is set once the topology is declared
+	declared bool
+	// stopped is set on stop, the client isn't dialed anymore
+	stopped bool
+	stopCh  chan struct{}
+
+	// state is the snapshot of the fields above for the health checks and metrics, which don't take p.mu
+	state atomic.Pointer[pluginState]
 }
 
 func (p *Plugin) Name() string {
@@ -56,6 +73,27 @@ func (p *Plugin) Init(cfg common.Configurer, log common.Logger, srv common.Serve
 
 	p.log = log.NamedLogger(pluginName)
 
+	var raw map[string]any
+	err = cfg.UnmarshalKey(pluginName, &raw)
+	if err == nil {
+		unused, err := unusedKeys(raw)
+		if err != nil {
+			p.log.Debug("failed to check unused config keys", zap.Error(err))
+		}
+		for _, key := range unused {
+			p.log.Warn("config key is not used and will be ignored", zap.String("key", key))
+		}
+	}
+
+	err = p.cfg.Validate()
+	if err != nil {
+		return errors.E(op, err)
+	}
+
+	p.metrics = newMetrics(p)
+	p.bodies = newBodyStore()
+	p.stopCh = make(chan struct{})
+
 	p.server = srv
 
 	return nil
@@ -68,9 +106,16 @@ func (p *Plugin) getClient() (*amqp.Client, error) {
 	if p.client != nil {
 		return p.client, nil
 	}
+	if p.stopped {
+		return nil, errors.Str("the plugin is stopped")
+	}
 
-	var err error
-	p.client, err = amqp.Dial(p.cfg.Amqp.Addr, p.log)
+	addr, err := p.cfg.Amqp.URL()
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve amqp address: %w", err)
+	}
+
+	p.client, err = amqp.Dial(addr, p.log, amqp.WithObserver(p.metrics), amqp.WithAddrFunc(p.cfg.Amqp.URL))
 	if err != nil {
 		return nil, fmt.Errorf("failed to dial amqp: %w", err)
 	}
@@ -80,6 +125,8 @@ func (p *Plugin) getClient() (*amqp.Client, error) {
 	if err != nil {
 		return nil, fmt.Errorf("failed to declare amqp entities: %w", err)
 	}
+	p.declared = true
+	p.publishState()
 
 	return p.client, nil
 }
@@ -88,7 +135,8 @@ func (p *Plugin) getClient() (*amqp.Client, error) {
 func (p *Plugin) Serve() chan error {
 	errCh := make(chan error, 2)
 
-	if p.cfg.Pool == nil || p.cfg.Pool.NumWorkers == 0 || len(p.cfg.Consumers) == 0 {
+	if (p.cfg.Pool == nil && len(p.cfg.Pools) == 0) || (len(p.cfg.Consumers) == 0 && p.cfg.DynamicConsumersFile == "") {
+		go p.connect()
 		return errCh
 	}
 
@@ -102,47 +150,245 @@ func (p *Plugin) Serve() chan error {
 	p.mu.Lock()
 	defer p.mu.Unlock()
 
-	p.pool, err = p.server.NewPool(context.Background(), p.cfg.Pool, nil, p.log)
-	if err != nil {
-		p.log.Error("failed to create pool", zap.Error(err))
-		errCh <- err
-		return errCh
+	p.pools = make(map[string]*Worker, len(p.cfg.Pools)+1)
+
+	if p.cfg.Pool != nil {
+		err = p.newPool(client, "", p.cfg.Pool, nil)
+		if err != nil {
+			errCh <- err
+			return errCh
+		}
 	}
 
-	p.wp = NewWorkerPool(p.pool, int(p.cfg.Pool.NumWorkers), p.log)
+	for name, poolConfig := range p.cfg.Pools {
+		err = p.newPool(client, name, &poolConfig.Config, poolConfig.Env)
+		if err != nil {
+			errCh <- err
+			return errCh
+		}
+	}
 
-	for _, consumer := range p.cfg.Consumers {
-		deliveries, err := client.Consume(
-			consumer.Queue,
-			consumer.ConsumerID,
-			false,
-			false,
-			false,
-			false,
-			nil,
-			consumer.Prefetch,
-		)
+	for _, consumerConfig := range p.cfg.Consumers {
+		_, err = p.startConsumer(client, consumerConfig, nil)
+		if err != nil {
+			errCh <- err
+			return errCh
+		}
+	}
+
+	if p.cfg.DynamicConsumersFile != "" {
+		definitions, err := loadDynamicConsumers(p.cfg.DynamicConsumersFile)
 		if err != nil {
 			errCh <- err
 			return errCh
 		}
 
-		p.wp.Consume(deliveries, consumer)
+		for _, definition := range definitions {
+			consumerConfig, err := decodeConsumerConfig(definition)
+			if err != nil {
+				errCh <- err
+				return errCh
+			}
+
+			_, err = p.startConsumer(client, consumerConfig, definition)
+			if err != nil {
+				errCh <- err
+				return errCh
+			}
+		}
 	}
 
 	return errCh
 }
 
+// connect dials the client of a plugin without consumers, which would otherwise connect on the first publish,
+// so the instance becomes ready without publishing. It retries until the client connects or the plugin stops.
+func (p *Plugin) connect() {
+	for {
+		_, err := p.getClient()
+		if err == nil {
+			return
+		}
+		p.log.Warn("failed to connect, retrying", zap.Error(err))
+
+		select {
+		case <-p.stopCh:
+			return
+		case <-time.After(3 * time.Second):
+		}
+	}
+}
+
+// newPool creates a worker pool, p.mu must be held
+func (p *Plugin) newPool(client *amqp.Client, name string, cfg *pool.Config, env map[string]string) error {
+	log := p.log
+	if name != "" {
+		log = log.With(zap.String("pool", name))
+	}
+
+	cfg = supervisedPoolConfig(cfg)
+
+	workerPool, err := p.server.NewPool(context.Background(), cfg, env, log)
+	if err != nil {
+		log.Error("failed to create pool", zap.Error(err))
+		return fmt.Errorf("failed to create pool %s: %w", name, err)
+	}
+
+	wp := NewWorkerPool(context.Background(), workerPool, client, int(cfg.NumWorkers), p.metrics, log)
+	wp.bodies = p.bodies
+	p.pools[name] = wp
+	p.publishState()
+
+	return nil
+}
+
+// startConsumer starts consuming and feeds the deliveries to the consumer's worker pool, p.mu must be held.
+// Consumers with a definition were added at runtime.
+func (p *Plugin) startConsumer(client *amqp.Client, cfg *ConsumerConfig, definition map[string]any) (*consumer, error) {
+	wp, ok := p.pools[cfg.Pool]
+	if !ok {
+		if cfg.Pool == "" {
+			return nil, fmt.Errorf("consumer of queue %s has no pool, configure the default pool or set pool", cfg.Queue)
+		}
+		return nil, fmt.Errorf("consumer of queue %s references unknown pool %s", cfg.Queue, cfg.Pool)
+	}
+
+	c := newConsumer(cfg, wp.pool, p.log)
+	c.definition = definition
+	// streams support single active consumers only over the stream protocol
+	c.singleActive = cfg.Stream == nil && p.cfg.Amqp.singleActiveConsumer(cfg.Queue)
+
+	err := c.start(client)
+	if err != nil {
+		return nil, fmt.Errorf("failed to start consumer of queue %s: %w", cfg.Queue, err)
+	}
+
+	p.consumers = append(p.consumers, c)
+	p.publishState()
+	wp.Consume(c)
+
+	return c, nil
+}
+
+// addConsumer starts a consumer defined at runtime
+func (p *Plugin) addConsumer(definition map[string]any) (*consumer, error) {
+	cfg, err := decodeConsumerConfig(definition)
+	if err != nil {
+		return nil, err
+	}
+
+	client, err := p.getClient()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get client: %w", err)
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.pools == nil {
+		return nil, errors.Str("consumers are not running, configure the pool and consumers or dynamic_consumers_file")
+	}
+
+	if cfg.ConsumerID != "" {
+		for _, c := range p.consumers {
+			if c.amqp.Tag() == cfg.ConsumerID {
+				return nil, fmt.Errorf("consumer %s already exists", cfg.ConsumerID)
+			}
+		}
+	}
+
+	c, err := p.startConsumer(client, cfg, definition)
+	if err != nil {
+		return nil, err
+	}
+
+	err = p.saveDynamicConsumers()
+	if err != nil {
+		// a consumer which isn't persisted would silently disappear on restart, the caller can retry instead
+		p.consumers = p.consumers[:len(p.consumers)-1]
+		p.publishState()
+		c.stop()
+		closeErr := c.amqp.Close()
+		if closeErr != nil {
+			p.log.Warn("failed to close the consumer", zap.String("queue", cfg.Queue), zap.Error(closeErr))
+		}
+		c.restoreWorkers()
+		return nil, err
+	}
+	p.log.Info("consumer added", zap.String("queue", cfg.Queue), zap.String("consumer", c.amqp.Tag()))
+
+	return c, nil
+}
+
+// removeConsumer drains the consumer and closes its channel, messages still in flight after the timeout are requeued
+func (p *Plugin) removeConsumer(ctx context.Context, c *consumer) error {
+	err := c.drain(ctx)
+	if err != nil {
+		p.log.Warn("consumer was not drained before removal", zap.String("queue", c.cfg.Queue), zap.Error(err))
+	}
+
+	c.stop()
+	err = c.amqp.Close()
+	if err != nil {
+		return err
+	}
+	c.restoreWorkers()
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for i, existing := range p.consumers {
+		if existing == c {
+			p.consumers = append(p.consumers[:i], p.consumers[i+1:]...)
+			break
+		}
+	}
+	p.publishState()
+	p.log.Info("consumer removed", zap.String("queue", c.cfg.Queue), zap.String("consumer", c.amqp.Tag()))
+
+	if c.definition == nil {
+		return nil
+	}
+
+	return p.saveDynamicConsumers()
+}
+
+// saveDynamicConsumers persists definitions of consumers added at runtime, p.mu must be held
+func (p *Plugin) saveDynamicConsumers() error {
+	if p.cfg.DynamicConsumersFile == "" {
+		return nil
+	}
+
+	definitions := make([]map[string]any, 0, len(p.consumers))
+	for _, c := range p.consumers {
+		if c.definition != nil {
+			definitions = append(definitions, c.definition)
+		}
+	}
+
+	err := saveDynamicConsumers(p.cfg.DynamicConsumersFile, definitions)
+	if err != nil {
+		return fmt.Errorf("failed to persist dynamic consumers: %w", err)
+	}
+
+	return nil
+}
+
 func (p *Plugin) declare() error {
 	for _, queueConfig := range p.cfg.Amqp.Queue {
 		p.log.Debug("declaring queue", zap.Any("queue", queueConfig))
-		err := p.client.DeclareQueue(
+		args, err := queueConfig.Arguments()
+		if err != nil {
+			return fmt.Errorf("invalid queue %s: %w", queueConfig.Name, err)
+		}
+
+		err = p.client.DeclareQueue(
 			queueConfig.Name,
 			queueConfig.Durable,
 			queueConfig.AutoDelete,
 			queueConfig.Exclusive,
 			queueConfig.NoWait,
-			queueConfig.Args,
+			args,
 		)
 		if err != nil {
 			return fmt.Errorf("failed to declare queue %s: %w", queueConfig.Name, err)
@@ -179,85 +425,227 @@ func (p *Plugin) declare() error {
 		}
 	}
 
+	for _, superStreamConfig := range p.cfg.Amqp.SuperStream {
+		p.log.Debug("declaring super stream", zap.Any("superStream", superStreamConfig))
+		err := p.declareSuperStream(superStreamConfig)
+		if err != nil {
+			return fmt.Errorf("failed to declare super stream %s: %w", superStreamConfig.Name, err)
+		}
+	}
+
 	return nil
 }
 
-// TODO: we should stop the workers first and then close the client to allow workers to finish their work
+func (p *Plugin) declareSuperStream(cfg *SuperStreamConfig) error {
+	if cfg.Partitions <= 0 {
+		return errors.Str("partitions must be greater than 0")
+	}
 
-func (p *Plugin) Stop(ctx context.Context) error {
-	p.mu.Lock()
-	defer p.mu.Unlock()
+	err := p.client.DeclareExchange(cfg.Name, "direct", true, false, false, false, amqp.Table{
+		"x-super-stream": true,
+	})
+	if err != nil {
+		return err
+	}
 
-	doneCh := make(chan error, 1)
+	for i := 0; i < cfg.Partitions; i++ {
+		args := amqp.Table{}
+		for key, value := range cfg.Args {
+			args[key] = value
+		}
+		args["x-queue-type"] = "stream"
 
-	go func() {
-		err := p.client.Close()
+		err = p.client.DeclareQueue(cfg.partitionName(i), true, false, false, false, args)
 		if err != nil {
-			doneCh <- err
-			return
+			return err
+		}
+
+		err = p.client.BindQueue(cfg.partitionName(i), cfg.Name, strconv.Itoa(i), false, amqp.Table{
+			"x-stream-partition-order": int64(i),
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (p *Plugin) superStream(name string) *SuperStreamConfig {
+	for _, superStreamConfig := range p.cfg.Amqp.SuperStream {
+		if superStreamConfig.Name == name {
+			return superStreamConfig
 		}
-		p.wp.WaitClose()
-		doneCh <- nil
+	}
+
+	return nil
+}
+
+func (p *Plugin) Stop(ctx context.Context) error {
+	// the consumers and pools are taken out, so nothing is added to them or reset during the shutdown.
+	// p.mu isn't held meanwhile, the client keeps publishing for the messages still in flight.
+	p.mu.Lock()
+	consumers, pools := p.consumers, p.pools
+	p.consumers, p.pools = nil, nil
+	if !p.stopped {
+		p.stopped = true
+		close(p.stopCh)
+	}
+	p.publishState()
+	p.mu.Unlock()
+
+	doneCh := make(chan struct{})
+	go func() {
+		defer close(doneCh)
+		p.shutdown(ctx, consumers, pools)
 	}()
 
 	var err error
 	select {
 	case <-ctx.Done():
 		err = ctx.Err()
-	case err = <-doneCh:
+	case <-doneCh:
 	}
 
+	p.mu.Lock()
+	client := p.client
 	p.client = nil
+	p.declared = false
+	p.publishState()
+	p.mu.Unlock()
+
+	if client != nil {
+		closeErr := client.Close()
+		if err == nil {
+			err = closeErr
+		}
+	}
 
 	return err
 }
 
+// shutdown cancels the consumers and waits for in-flight messages up to the shutdown timeout,
+// messages still in flight afterward are requeued
+func (p *Plugin) shutdown(ctx context.Context, consumers []*consumer, pools map[string]*Worker) {
+	// the broker stops delivering first, so nothing new arrives while the workers stop
+	for _, c := range consumers {
+		err := c.pause()
+		if err != nil {
+			p.log.Warn("failed to cancel consumer", zap.String("queue", c.cfg.Queue), zap.Error(err))
+		}
+	}
+
+	// deliveries not executed yet are requeued
+	for _, wp := range pools {
+		wp.StopFeeding()
+	}
+
+	graceCtx, cancel := context.WithTimeout(ctx, p.cfg.ShutdownTimeout)
+	var wg sync.WaitGroup
+	for _, c := range consumers {
+		wg.Add(1)
+		go func(c *consumer) {
+			defer wg.Done()
+
+			err := c.drain(graceCtx)
+			if err != nil {
+				p.log.Warn("consumer was not drained before shutdown", zap.String("queue", c.cfg.Queue), zap.Error(err))
+			}
+		}(c)
+	}
+	wg.Wait()
+	cancel()
+
+	// in-flight messages are requeued while the connection is still open
+	for _, wp := range pools {
+		wp.Cancel()
+	}
+	for _, c := range consumers {
+		c.stop()
+	}
+
+	for _, wp := range pools {
+		wp.pool.Destroy(ctx)
+	}
+
+	for _, c := range consumers {
+		err := c.amqp.Close()
+		if err != nil {
+			p.log.Warn("failed to close consumer channel", zap.String("queue", c.cfg.Queue), zap.Error(err))
+		}
+	}
+	for _, wp := range pools {
+		wp.WaitClose()
+	}
+}
+
 // Workers returns slice with the process states for the workers
 func (p *Plugin) Workers() []*process.State {
 	p.mu.RLock()
 	defer p.mu.RUnlock()
 
-	if p.pool == nil {
-		return nil
-	}
-
-	workers := p.pool.Workers()
+	var ps []*process.State
+	for _, wp := range p.pools {
+		workers := wp.pool.Workers()
 
-	ps := make([]*process.State, 0, len(workers))
-	for i := 0; i < len(workers); i++ {
-		state, err := process.WorkerProcessState(workers[i])
-		if err != nil {
-			return nil
+		for i := 0; i < len(workers); i++ {
+			state, err := process.WorkerProcessState(workers[i])
+			if err != nil {
+				return nil
+			}
+			ps = append(ps, state)
 		}
-		ps = append(ps, state)
 	}
 
 	return ps
 }
 
-// Reset destroys the old pool and replaces it with new one, waiting for old pool to die
+// Reset destroys the old pool and replaces it with new one, waiting for old pool to die.
+// p.mu isn't held while in-flight executions finish, resets are serialized by p.resetMu.
 func (p *Plugin) Reset() error {
 	const op = errors.Op("http_plugin_reset")
 
-	p.mu.Lock()
-	defer p.mu.Unlock()
+	p.resetMu.Lock()
+	defer p.resetMu.Unlock()
 
 	p.log.Info("reset signal was received")
 
-	if p.pool == nil {
+	p.mu.RLock()
+	pools := make(map[string]*Worker, len(p.pools))
+	for name, wp := range p.pools {
+		pools[name] = wp
+	}
+	p.mu.RUnlock()
+
+	if len(pools) == 0 {
 		p.log.Info("pool is nil, nothing to reset")
 		return nil
 	}
 
-	err := p.pool.Reset(context.Background())
-	if err != nil {
-		return errors.E(op, err)
+	for name, wp := range pools {
+		var err error
+		if p.cfg.ResetMode == ResetRolling {
+			err = wp.RollingReset(context.Background())
+		} else {
+			err = wp.Reset(context.Background())
+		}
+		if err != nil {
+			if name != "" {
+				return errors.E(op, fmt.Errorf("failed to reset pool %s: %w", name, err))
+			}
+			return errors.E(op, err)
+		}
 	}
 
 	p.log.Info("plugin was successfully reset")
 	return nil
 }
 
+// MetricsCollector implements the metrics plugin StatProvider
+func (p *Plugin) MetricsCollector() []prometheus.Collector {
+	return p.metrics.collectors()
+}
+
 // RPC returns associated rpc service.
 func (p *Plugin) RPC() any {
 	p.mu.Lock()
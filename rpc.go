@@ -1,6 +1,11 @@
 package thumper
 
-import "fmt"
+import (
+	"context"
+	"fmt"
+	"github.com/roadrunner-server/errors"
+	"time"
+)
 
 // TODO: improve error handling, ideally the client will be able to distinguish between rr and amqp errors
 
@@ -13,9 +18,14 @@ type Message struct {
 	Key      string `msgpack:"alias:key" json:"key"`
 
 	ContentType string `msgpack:"alias:contentType" json:"contentType"`
+	// ContentEncoding is set for bodies encoded by the caller, they are not compressed again
+	ContentEncoding string `msgpack:"alias:contentEncoding" json:"contentEncoding"`
 
 	Message string         `msgpack:"alias:message" json:"message"`
 	Headers map[string]any `msgpack:"alias:headers" json:"headers"`
+
+	// FilterValue is sent as the x-stream-filter-value header
+	FilterValue string `msgpack:"alias:filterValue" json:"filterValue"`
 }
 
 func (r *rpc) Publish(message *Message, _ *bool) error {
@@ -24,15 +34,56 @@ func (r *rpc) Publish(message *Message, _ *bool) error {
 		return fmt.Errorf("failed to get client: %w", err)
 	}
 
-	return client.Publish(
+	return r.publish(client, message)
+}
+
+func (r *rpc) publish(client publisher, message *Message) error {
+	var err error
+	if message.Headers == nil {
+		message.Headers = map[string]any{}
+	}
+
+	if message.FilterValue != "" {
+		message.Headers["x-stream-filter-value"] = message.FilterValue
+	}
+
+	key := message.Key
+	if superStream := r.plugin.superStream(message.Exchange); superStream != nil {
+		key, err = superStream.route(message)
+		if err != nil {
+			return err
+		}
+	}
+
+	span := startPublishSpan(message.Exchange, key, message.Headers, len(message.Message))
+	defer span.End()
+
+	body := []byte(message.Message)
+	encoding := message.ContentEncoding
+	if compression := r.plugin.cfg.Compression; compression != nil && encoding == "" && len(body) > compression.Threshold {
+		body, err = compress(compression.Encoding, body)
+		if err != nil {
+			spanFailed(span, "failed to compress message", err)
+			return fmt.Errorf("failed to compress message: %w", err)
+		}
+		encoding = compression.Encoding
+	}
+
+	err = client.Publish(
 		message.Exchange,
-		message.Key,
+		key,
 		false,
 		false,
 		message.ContentType,
-		[]byte(message.Message),
+		encoding,
+		body,
 		message.Headers,
 	)
+	if err != nil {
+		spanFailed(span, "publish failed", err)
+	}
+
+	return err
 }
 
 type Exchange struct {
@@ -109,3 +160,147 @@ func (r *rpc) BindQueue(bind *BindQueue, _ *bool) error {
 		bind.Args,
 	)
 }
+
+type ConsumerStatus struct {
+	Queue      string `msgpack:"alias:queue" json:"queue"`
+	ConsumerID string `msgpack:"alias:consumerId" json:"consumerId"`
+	// Active marks the consumer receiving deliveries, on single active consumer queues it marks the leader
+	Active bool `msgpack:"alias:active" json:"active"`
+	// Standby is set on single active consumer queues when another consumer is the leader,
+	// neither Active nor Standby is set until the broker state shows which one it is
+	Standby bool `msgpack:"alias:standby" json:"standby"`
+	// Since is the RFC 3339 time of the last state transition
+	Since string `msgpack:"alias:since" json:"since"`
+	// ScaledDown is the number of workers removed from the pool while on standby
+	ScaledDown int `msgpack:"alias:scaledDown" json:"scaledDown"`
+	// State is running, paused or drained (paused with no messages in flight)
+	State    string `msgpack:"alias:state" json:"state"`
+	InFlight int    `msgpack:"alias:inFlight" json:"inFlight"`
+	// Held is the number of messages waiting locally for their key to be below the key limit
+	Held int `msgpack:"alias:held" json:"held"`
+	// Dynamic is set for consumers added over RPC
+	Dynamic bool `msgpack:"alias:dynamic" json:"dynamic"`
+}
+
+func (r *rpc) ListConsumers(_ bool, consumers *[]*ConsumerStatus) error {
+	r.plugin.mu.RLock()
+	defer r.plugin.mu.RUnlock()
+
+	*consumers = make([]*ConsumerStatus, 0, len(r.plugin.consumers))
+	for _, c := range r.plugin.consumers {
+		*consumers = append(*consumers, c.status())
+	}
+
+	return nil
+}
+
+// AddConsumer starts a consumer, the definition has the same structure as a consumer in the config file
+func (r *rpc) AddConsumer(definition map[string]any, status *ConsumerStatus) error {
+	c, err := r.plugin.addConsumer(definition)
+	if err != nil {
+		return err
+	}
+
+	*status = *c.status()
+	return nil
+}
+
+// RemoveConsumer drains the selected consumers and stops them
+func (r *rpc) RemoveConsumer(target *ConsumerTarget, consumers *[]*ConsumerStatus) error {
+	timeout := 30 * time.Second
+	if target.Timeout > 0 {
+		timeout = time.Duration(target.Timeout) * time.Second
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	return r.eachConsumer(target, consumers, func(c *consumer) error {
+		return r.plugin.removeConsumer(ctx, c)
+	})
+}
+
+// ConsumerTarget selects consumers by consumer ID (tag) or queue
+type ConsumerTarget struct {
+	ConsumerID string `msgpack:"alias:consumerId" json:"consumerId"`
+	Queue      string `msgpack:"alias:queue" json:"queue"`
+	// Timeout in seconds to wait for in-flight messages when draining or removing, defaults to 30
+	Timeout int `msgpack:"alias:timeout" json:"timeout"`
+}
+
+func (r *rpc) PauseConsumer(target *ConsumerTarget, consumers *[]*ConsumerStatus) error {
+	return r.eachConsumer(target, consumers, func(c *consumer) error {
+		return c.pause()
+	})
+}
+
+func (r *rpc) ResumeConsumer(target *ConsumerTarget, consumers *[]*ConsumerStatus) error {
+	return r.eachConsumer(target, consumers, func(c *consumer) error {
+		return c.resume()
+	})
+}
+
+// DrainConsumer pauses the consumers and waits until their in-flight messages are processed
+func (r *rpc) DrainConsumer(target *ConsumerTarget, consumers *[]*ConsumerStatus) error {
+	timeout := 30 * time.Second
+	if target.Timeout > 0 {
+		timeout = time.Duration(target.Timeout) * time.Second
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	return r.eachConsumer(target, consumers, func(c *consumer) error {
+		return c.drain(ctx)
+	})
+}
+
+// eachConsumer applies fn to the consumers selected by the target and returns their status
+func (r *rpc) eachConsumer(target *ConsumerTarget, consumers *[]*ConsumerStatus, fn func(c *consumer) error) error {
+	if target.ConsumerID == "" && target.Queue == "" {
+		return errors.Str("consumer id or queue is required")
+	}
+
+	r.plugin.mu.RLock()
+	matched := make([]*consumer, 0, 1)
+	for _, c := range r.plugin.consumers {
+		if target.ConsumerID != "" && c.amqp.Tag() != target.ConsumerID {
+			continue
+		}
+		if target.Queue != "" && c.cfg.Queue != target.Queue {
+			continue
+		}
+		matched = append(matched, c)
+	}
+	r.plugin.mu.RUnlock()
+
+	if len(matched) == 0 {
+		return errors.Str("no consumer matched")
+	}
+
+	*consumers = make([]*ConsumerStatus, 0, len(matched))
+	for _, c := range matched {
+		err := fn(c)
+		if err != nil {
+			return fmt.Errorf("consumer %s: %w", c.amqp.Tag(), err)
+		}
+		*consumers = append(*consumers, c.status())
+	}
+
+	return nil
+}
+
+type BodyChunk struct {
+	ID     string `msgpack:"alias:id" json:"id"`
+	Offset int64  `msgpack:"alias:offset" json:"offset"`
+	// Size of the chunk, up to 16 MiB
+	Size int `msgpack:"alias:size" json:"size"`
+}
+
+// ReadBody reads a chunk of a large body of the message being processed, the chunk is empty at the end of the body
+func (r *rpc) ReadBody(chunk *BodyChunk, body *[]byte) error {
+	var err error
+	*body, err = r.plugin.bodies.read(chunk.ID, chunk.Offset, chunk.Size)
+
+	return err
+}
@@ -0,0 +1,264 @@
+package thumper
+
+import (
+	"sync"
+)
+
+// scheduler dispatches messages of consumers sharing a pool using weighted round-robin.
+// Each consumer has a lane, a backlogged lane gets up to weight messages per round,
+// so a flood on one queue can't starve the others.
+type scheduler struct {
+	mu   sync.Mutex
+	cond *sync.Cond
+
+	lanes []*lane
+	// next is the lane the round continues with
+	next   int
+	closed bool
+	// paused holds messages back from the workers
+	paused bool
+}
+
+type lane struct {
+	weight      int
+	maxInFlight int
+	// capacity is the number of messages buffered in the lane
+	capacity int
+	// limiters restrict in-flight messages per key, a message holds a key for each of them
+	limiters []*keyLimiter
+
+	queue    []*message
+	inFlight int
+	// credit is the number of messages the lane can still dispatch in the current round
+	credit int
+	closed bool
+}
+
+// keyLimiter allows up to limit in-flight messages with the same key
+type keyLimiter struct {
+	limit    int
+	inFlight map[string]int
+}
+
+func newKeyLimiter(limit int) *keyLimiter {
+	return &keyLimiter{
+		limit:    limit,
+		inFlight: make(map[string]int),
+	}
+}
+
+func newScheduler() *scheduler {
+	s := &scheduler{}
+	s.cond = sync.NewCond(&s.mu)
+
+	return s
+}
+
+// addLane registers a consumer lane, up to max(weight, capacity) messages are buffered in it.
+// Messages with keys held by limiters wait in the lane, so keyed lanes need a larger buffer
+// for messages of other keys to get through.
+func (s *scheduler) addLane(weight, maxInFlight, capacity int, limiters ...*keyLimiter) *lane {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if weight < 1 {
+		weight = 1
+	}
+	if capacity < weight {
+		capacity = weight
+	}
+
+	l := &lane{
+		weight:      weight,
+		maxInFlight: maxInFlight,
+		capacity:    capacity,
+		limiters:    limiters,
+	}
+	s.lanes = append(s.lanes, l)
+
+	return l
+}
+
+// closeLane removes the lane once its buffered messages are dispatched
+func (s *scheduler) closeLane(l *lane) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	l.closed = true
+	s.cond.Broadcast()
+}
+
+// push adds the message to the lane, it blocks while the lane is full
+func (s *scheduler) push(l *lane, msg *message) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for len(l.queue) >= l.capacity {
+		s.cond.Wait()
+	}
+
+	msg.lane = l
+	l.queue = append(l.queue, msg)
+	s.cond.Broadcast()
+}
+
+// pop returns the next message to process, it blocks until there is one or the scheduler is closed
+func (s *scheduler) pop() (*message, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for {
+		var msg *message
+		if !s.paused || s.closed {
+			msg = s.pick()
+		}
+		if msg != nil {
+			s.cond.Broadcast()
+			return msg, true
+		}
+
+		if s.closed && len(s.lanes) == 0 {
+			return nil, false
+		}
+
+		s.cond.Wait()
+	}
+}
+
+// done releases the in-flight slot of the message lane
+func (s *scheduler) done(msg *message) {
+	if msg.lane == nil {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	msg.lane.inFlight--
+	for i, limiter := range msg.lane.limiters {
+		key := msg.keys[i]
+		if key == "" {
+			continue
+		}
+		if limiter.inFlight[key] <= 1 {
+			delete(limiter.inFlight, key)
+		} else {
+			limiter.inFlight[key]--
+		}
+	}
+	s.cond.Broadcast()
+}
+
+// held returns the number of lane messages waiting for their key to be below the limit
+func (s *scheduler) held(l *lane) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	held := 0
+	for _, msg := range l.queue {
+		if !l.allowed(msg) {
+			held++
+		}
+	}
+
+	return held
+}
+
+// pause stops dispatching messages until resumed, messages are still buffered in the lanes
+func (s *scheduler) pause() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.paused = true
+}
+
+func (s *scheduler) resume() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.paused = false
+	s.cond.Broadcast()
+}
+
+// close stops the scheduler once all lanes are closed and drained
+func (s *scheduler) close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.closed = true
+	s.cond.Broadcast()
+}
+
+// pick takes the next message in the round, s.mu must be held
+func (s *scheduler) pick() *message {
+	for i := 0; i < len(s.lanes); {
+		if s.next >= len(s.lanes) {
+			s.next = 0
+		}
+		l := s.lanes[s.next]
+
+		if l.closed && len(l.queue) == 0 {
+			s.lanes = append(s.lanes[:s.next], s.lanes[s.next+1:]...)
+			continue
+		}
+
+		if index := l.ready(); index >= 0 {
+			if l.credit <= 0 {
+				l.credit = l.weight
+			}
+			l.credit--
+
+			msg := l.queue[index]
+			copy(l.queue[index:], l.queue[index+1:])
+			l.queue[len(l.queue)-1] = nil
+			l.queue = l.queue[:len(l.queue)-1]
+			l.inFlight++
+			for i, limiter := range l.limiters {
+				if msg.keys[i] != "" {
+					limiter.inFlight[msg.keys[i]]++
+				}
+			}
+
+			if l.credit == 0 {
+				s.next++
+			}
+
+			return msg
+		}
+
+		// an idle lane doesn't keep its credit for later rounds
+		l.credit = 0
+		s.next++
+		i++
+	}
+
+	return nil
+}
+
+// ready returns the index of the first message that can be dispatched, -1 when there is none.
+// Messages of a key are dispatched in order, a message is skipped only while its key is at the limit,
+// and then so are the later ones of the key.
+func (l *lane) ready() int {
+	if l.maxInFlight != 0 && l.inFlight >= l.maxInFlight {
+		return -1
+	}
+
+	for index, msg := range l.queue {
+		if l.allowed(msg) {
+			return index
+		}
+	}
+
+	return -1
+}
+
+func (l *lane) allowed(msg *message) bool {
+	for i, limiter := range l.limiters {
+		key := msg.keys[i]
+		if key != "" && limiter.inFlight[key] >= limiter.limit {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,154 @@
+package thumper
+
+import (
+	"github.com/dstrop/thumper/amqp"
+	amqp091 "github.com/rabbitmq/amqp091-go"
+	"slices"
+	"testing"
+)
+
+func testMessage(id string, keys ...string) *message {
+	return &message{
+		delivery: &amqp.Delivery{Delivery: amqp091.Delivery{MessageId: id}},
+		keys:     keys,
+	}
+}
+
+// dispatch pops the messages which can be dispatched right now, without blocking
+func dispatch(s *scheduler) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var ids []string
+	for msg := s.pick(); msg != nil; msg = s.pick() {
+		ids = append(ids, msg.delivery.MessageId)
+	}
+
+	return ids
+}
+
+func TestSchedulerWeightedRoundRobin(t *testing.T) {
+	tests := []struct {
+		name    string
+		weights []int
+		pushed  []int
+		want    []string
+	}{
+		{name: "equal weights", weights: []int{1, 1}, pushed: []int{3, 3}, want: []string{"a0", "b0", "a1", "b1", "a2", "b2"}},
+		{name: "weighted", weights: []int{2, 1}, pushed: []int{4, 4}, want: []string{"a0", "a1", "b0", "a2", "a3", "b1", "b2", "b3"}},
+		{name: "idle lane", weights: []int{3, 1}, pushed: []int{1, 3}, want: []string{"a0", "b0", "b1", "b2"}},
+		{name: "zero weight", weights: []int{0, 2}, pushed: []int{2, 2}, want: []string{"a0", "b0", "b1", "a1"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newScheduler()
+			for i, weight := range tt.weights {
+				l := s.addLane(weight, 0, 10)
+				for j := 0; j < tt.pushed[i]; j++ {
+					s.push(l, testMessage(string(rune('a'+i))+string(rune('0'+j))))
+				}
+			}
+
+			if got := dispatch(s); !slices.Equal(got, tt.want) {
+				t.Errorf("dispatched %v, expected %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSchedulerMaxInFlight(t *testing.T) {
+	s := newScheduler()
+	limited := s.addLane(1, 1, 10)
+	other := s.addLane(1, 0, 10)
+	s.push(limited, testMessage("a0"))
+	s.push(limited, testMessage("a1"))
+	s.push(other, testMessage("b0"))
+	s.push(other, testMessage("b1"))
+
+	if got := dispatch(s); !slices.Equal(got, []string{"a0", "b0", "b1"}) {
+		t.Fatalf("dispatched %v, expected [a0 b0 b1]", got)
+	}
+
+	s.done(testMessage("a0"))
+	if got := dispatch(s); len(got) != 0 {
+		t.Fatalf("a message without a lane released a slot, dispatched %v", got)
+	}
+
+	msg := testMessage("a0")
+	msg.lane = limited
+	s.done(msg)
+	if got := dispatch(s); !slices.Equal(got, []string{"a1"}) {
+		t.Errorf("dispatched %v, expected [a1]", got)
+	}
+}
+
+func TestSchedulerClose(t *testing.T) {
+	s := newScheduler()
+	l := s.addLane(1, 0, 1)
+	s.push(l, testMessage("a0"))
+	s.closeLane(l)
+	s.close()
+
+	msg, ok := s.pop()
+	if !ok || msg.delivery.MessageId != "a0" {
+		t.Fatalf("buffered message of a closed lane wasn't dispatched")
+	}
+
+	_, ok = s.pop()
+	if ok {
+		t.Error("expected the scheduler to be closed")
+	}
+	if len(s.lanes) != 0 {
+		t.Errorf("closed lane wasn't removed")
+	}
+}
+
+func TestSchedulerPushWaitsForCapacity(t *testing.T) {
+	s := newScheduler()
+	l := s.addLane(1, 0, 1)
+	s.push(l, testMessage("a0"))
+
+	pushed := make(chan struct{})
+	go func() {
+		s.push(l, testMessage("a1"))
+		close(pushed)
+	}()
+
+	msg, _ := s.pop()
+	<-pushed
+	if msg.delivery.MessageId != "a0" {
+		t.Errorf("dispatched %s, expected a0", msg.delivery.MessageId)
+	}
+	if got := dispatch(s); !slices.Equal(got, []string{"a1"}) {
+		t.Errorf("dispatched %v, expected [a1]", got)
+	}
+}
+
+func TestSchedulerPause(t *testing.T) {
+	s := newScheduler()
+	l := s.addLane(1, 0, 10)
+	s.pause()
+	s.push(l, testMessage("a0"))
+
+	popped := make(chan *message)
+	go func() {
+		msg, _ := s.pop()
+		popped <- msg
+	}()
+
+	s.resume()
+	if msg := <-popped; msg.delivery.MessageId != "a0" {
+		t.Errorf("dispatched %s, expected a0", msg.delivery.MessageId)
+	}
+
+	// a closed scheduler dispatches buffered messages even while paused
+	s.pause()
+	s.push(l, testMessage("a1"))
+	s.closeLane(l)
+	s.close()
+	msg, ok := s.pop()
+	if !ok || msg.delivery.MessageId != "a1" {
+		t.Errorf("buffered message wasn't dispatched after close")
+	}
+}
@@ -0,0 +1,16 @@
+<?php declare(strict_types=1);
+
+namespace Thumper;
+
+class Batch
+{
+    /**
+     * @param list<Message> $messages
+     * @param array<string, string> $trace W3C trace context headers of the batch span
+     */
+    public function __construct(
+        public readonly array $messages,
+        public readonly array $trace = [],
+    ) {
+    }
+}
@@ -0,0 +1,13 @@
+<?php declare(strict_types=1);
+
+namespace Thumper;
+
+/**
+ * Codec of the message context, it must match the consumer's codec.
+ * Contexts encoded with proto are decoded with classes generated from proto/thumper.proto.
+ */
+enum ContextCodec: string
+{
+    case Json = 'json';
+    case Msgpack = 'msgpack';
+}
@@ -6,6 +6,8 @@ class Message
 {
     /**
      * @param array<string, list<string>> $headers
+     * @param ?string $bodyId Set instead of the body for large bodies, read them with Thumper::readBody()
+     * @param array<string, string> $trace W3C trace context headers of the consumer span (traceparent, tracestate, baggage)
      */
     public function __construct(
         public readonly string $body,
@@ -14,6 +16,9 @@ class Message
         public readonly string $exchange,
         public readonly string $routingKey,
         public readonly int $deliveryTag,
+        public readonly ?string $bodyId = null,
+        public readonly int $bodySize = 0,
+        public readonly array $trace = [],
     ) {
     }
 }
@@ -23,9 +23,17 @@ class Thumper implements ThumperInterface
         string $key,
         string $contentType,
         string $message,
-        array $headers = []
+        array $headers = [],
+        ?string $filterValue = null,
+        ?string $contentEncoding = null
     ): void {
         $payload = \compact('exchange', 'key', 'contentType', 'message');
+        if ($filterValue !== null) {
+            $payload['filterValue'] = $filterValue;
+        }
+        if ($contentEncoding !== null) {
+            $payload['contentEncoding'] = $contentEncoding;
+        }
 
         foreach (\array_keys($headers) as $key) {
             if (!\is_string($key)) {
@@ -113,4 +121,93 @@ class Thumper implements ThumperInterface
 
         $this->rpc->call('BindQueue', $payload);
     }
+
+    /**
+     * @return list<array{queue: string, consumerId: string, active: bool, standby: bool, since: string, scaledDown: int, state: string, inFlight: int, held: int, dynamic: bool}>
+     */
+    public function listConsumers(): array
+    {
+        /** @var list<array{queue: string, consumerId: string, active: bool, standby: bool, since: string, scaledDown: int, state: string, inFlight: int, held: int, dynamic: bool}> */
+        return $this->rpc->call('ListConsumers', true);
+    }
+
+    /**
+     * Stop consuming from the queue, messages already received are still processed.
+     *
+     * @return list<array<string, mixed>>
+     */
+    public function pauseConsumer(?string $consumerId = null, ?string $queue = null): array
+    {
+        /** @var list<array<string, mixed>> */
+        return $this->rpc->call('PauseConsumer', \array_filter(\compact('consumerId', 'queue')));
+    }
+
+    /**
+     * @return list<array<string, mixed>>
+     */
+    public function resumeConsumer(?string $consumerId = null, ?string $queue = null): array
+    {
+        /** @var list<array<string, mixed>> */
+        return $this->rpc->call('ResumeConsumer', \array_filter(\compact('consumerId', 'queue')));
+    }
+
+    /**
+     * Pause the consumer and wait until the messages already received are processed.
+     *
+     * @param int $timeout Seconds to wait for in-flight messages.
+     * @return list<array<string, mixed>>
+     */
+    public function drainConsumer(?string $consumerId = null, ?string $queue = null, int $timeout = 30): array
+    {
+        /** @var list<array<string, mixed>> */
+        return $this->rpc->call('DrainConsumer', \array_filter(\compact('consumerId', 'queue', 'timeout')));
+    }
+
+    /**
+     * Start a consumer, the definition has the same structure as a consumer in the config file.
+     *
+     * @param array<string, mixed> $definition
+     * @return array<string, mixed>
+     */
+    public function addConsumer(array $definition): array
+    {
+        /** @var array<string, mixed> */
+        return $this->rpc->call('AddConsumer', $definition);
+    }
+
+    /**
+     * Drain and stop the consumer, messages still in flight after the timeout are requeued.
+     *
+     * @param int $timeout Seconds to wait for in-flight messages.
+     * @return list<array<string, mixed>>
+     */
+    public function removeConsumer(?string $consumerId = null, ?string $queue = null, int $timeout = 30): array
+    {
+        /** @var list<array<string, mixed>> */
+        return $this->rpc->call('RemoveConsumer', \array_filter(\compact('consumerId', 'queue', 'timeout')));
+    }
+
+    /**
+     * Read the body of the message in chunks, large bodies are read over RPC until the worker responds.
+     *
+     * @param int $chunkSize Bytes per chunk, up to 16 MiB.
+     * @return \Generator<int, string>
+     */
+    public function readBody(Message $message, int $chunkSize = 1 << 20): \Generator
+    {
+        if ($message->bodyId === null) {
+            yield $message->body;
+            return;
+        }
+
+        for ($offset = 0; $offset < $message->bodySize; $offset += \strlen($chunk)) {
+            $payload = ['id' => $message->bodyId, 'offset' => $offset, 'size' => $chunkSize];
+            $chunk = \base64_decode((string)$this->rpc->call('ReadBody', $payload), true);
+            if ($chunk === false || $chunk === '') {
+                throw new \RuntimeException('Failed to read message body');
+            }
+
+            yield $chunk;
+        }
+    }
 }
@@ -7,18 +7,34 @@ use Spiral\RoadRunner\WorkerInterface as SpiralWorkerInterface;
 
 /**
  * @psalm-type MessageContext = array{
+ *     version: int,
  *     headers: ?array<string,
  *     list<string>>,
  *     queue: string,
  *     exchange: string,
  *     routingKey: string,
- *     deliveryTag: int
+ *     deliveryTag: int,
+ *     bodyId?: string,
+ *     bodySize?: int,
+ *     trace?: array<string, string>
+ * }
+ * @psalm-type BatchContext = array{
+ *     version: int,
+ *     queue: string,
+ *     messages: list<array{
+ *         headers: ?array<string, list<string>>,
+ *         exchange: string,
+ *         routingKey: string,
+ *         deliveryTag: int
+ *     }>,
+ *     trace?: array<string, string>
  * }
  */
 class Worker implements WorkerInterface
 {
     public function __construct(
         private readonly SpiralWorkerInterface $worker,
+        private readonly ContextCodec $codec = ContextCodec::Json,
     ) {
     }
 
@@ -40,7 +56,7 @@ class Worker implements WorkerInterface
         }
 
         /** @var MessageContext $context */
-        $context = \json_decode($payload->header, true, 512, \JSON_THROW_ON_ERROR);
+        $context = $this->decodeContext($payload->header);
 
         return new Message(
             body: $payload->body,
@@ -49,11 +65,81 @@ class Worker implements WorkerInterface
             exchange: $context['exchange'],
             routingKey: $context['routingKey'],
             deliveryTag: $context['deliveryTag'],
+            bodyId: $context['bodyId'] ?? null,
+            bodySize: $context['bodySize'] ?? 0,
+            trace: $context['trace'] ?? [],
         );
     }
 
+    /**
+     * @throws \JsonException
+     */
+    public function waitBatch(): ?Batch
+    {
+        $payload = $this->worker->waitPayload();
+
+        // Termination request
+        if ($payload === null || (!$payload->body && !$payload->header)) {
+            return null;
+        }
+
+        /** @var BatchContext $context */
+        $context = $this->decodeContext($payload->header);
+
+        // the bodies are a list in the order of the messages, JSON carries them base64 encoded
+        /** @var list<string> $bodies */
+        $bodies = $this->decodeContext($payload->body);
+        if ($this->codec === ContextCodec::Json) {
+            $bodies = \array_map(static fn (string $body): string => \base64_decode($body, true), $bodies);
+        }
+
+        $messages = [];
+        foreach ($context['messages'] as $i => $message) {
+            $messages[] = new Message(
+                body: $bodies[$i],
+                headers: $message['headers'] ?? [],
+                queue: $context['queue'],
+                exchange: $message['exchange'],
+                routingKey: $message['routingKey'],
+                deliveryTag: $message['deliveryTag'],
+            );
+        }
+
+        return new Batch($messages, $context['trace'] ?? []);
+    }
+
     public function respond(Response $response): void
     {
         $this->worker->respond(new Payload((string)$response->value));
     }
+
+    /**
+     * Stream a chunk of the reply, it's published to the reply_to queue of the message as it arrives,
+     * the last chunk once the worker responds with the result.
+     */
+    public function respondChunk(string $chunk): void
+    {
+        $this->worker->respond(new Payload($chunk, eos: false));
+    }
+
+    public function respondBatch(Response ...$responses): void
+    {
+        $body = '';
+        foreach ($responses as $response) {
+            $body .= (string)$response->value;
+        }
+
+        $this->worker->respond(new Payload($body));
+    }
+
+    /**
+     * @throws \JsonException
+     */
+    private function decodeContext(string $header): mixed
+    {
+        return match ($this->codec) {
+            ContextCodec::Json => \json_decode($header, true, 512, \JSON_THROW_ON_ERROR),
+            ContextCodec::Msgpack => \msgpack_unpack($header),
+        };
+    }
 }
@@ -11,10 +11,25 @@ interface WorkerInterface extends WorkerAwareInterface
      */
     public function waitMessage(): ?Message;
 
+    /**
+     * Wait for incoming batch of amqp messages, for consumers with batch enabled.
+     */
+    public function waitBatch(): ?Batch;
+
     /**
      * Send response to the application server.
      *
      * @param Response $response Response to send.
      */
     public function respond(Response $response): void;
+
+    /**
+     * Stream a chunk of the reply, followed by respond() with the result.
+     */
+    public function respondChunk(string $chunk): void;
+
+    /**
+     * Send a response for each message of the batch, in the order of the messages.
+     */
+    public function respondBatch(Response ...$responses): void;
 }
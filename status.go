@@ -0,0 +1,126 @@
+package thumper
+
+import (
+	"github.com/roadrunner-server/api/v4/plugins/v1/status"
+	"github.com/roadrunner-server/pool/fsm"
+	"go.uber.org/zap"
+	"maps"
+	"net/http"
+	"slices"
+)
+
+// connection is the client state read by the health checks and metrics, it's implemented by amqp.Client
+type connection interface {
+	Connected() bool
+	IdleChannels() int
+}
+
+// pluginState is a snapshot of the running plugin, the health checks and metrics read it
+// instead of taking p.mu, which is held while consumers are started or the client connects
+type pluginState struct {
+	// client is nil until the client connects
+	client    connection
+	declared  bool
+	consumers []*consumer
+	pools     map[string]*Worker
+}
+
+// publishState stores the snapshot of the plugin state, p.mu must be held
+func (p *Plugin) publishState() {
+	state := &pluginState{
+		declared:  p.declared,
+		consumers: slices.Clone(p.consumers),
+		pools:     maps.Clone(p.pools),
+	}
+	if p.client != nil {
+		state.client = p.client
+	}
+
+	p.state.Store(state)
+}
+
+func (p *Plugin) snapshot() *pluginState {
+	if state := p.state.Load(); state != nil {
+		return state
+	}
+
+	return &pluginState{}
+}
+
+// Status implements status.Checker, thumper is healthy while the connection is open,
+// no consumer channel is being reopened and each pool has a usable worker
+func (p *Plugin) Status() (*status.Status, error) {
+	state := p.snapshot()
+
+	if state.client != nil && !state.client.Connected() {
+		p.log.Debug("unhealthy, reconnecting")
+		return &status.Status{Code: http.StatusServiceUnavailable}, nil
+	}
+
+	for _, c := range state.consumers {
+		if !c.amqp.ChannelOpen() {
+			p.log.Debug("unhealthy, consumer channel is reopening", zap.String("queue", c.cfg.Queue))
+			return &status.Status{Code: http.StatusServiceUnavailable}, nil
+		}
+	}
+
+	for name, wp := range state.pools {
+		if !wp.hasActiveWorker() {
+			p.log.Debug("unhealthy, no active worker", zap.String("pool", name))
+			return &status.Status{Code: http.StatusServiceUnavailable}, nil
+		}
+	}
+
+	return &status.Status{Code: http.StatusOK}, nil
+}
+
+// Ready implements status.Readiness, thumper is ready once the connection is open, the topology is declared
+// and all configured consumers receive deliveries with a usable worker in their pool.
+// Consumers paused over RPC are skipped, pausing a queue doesn't take the instance out of rotation.
+func (p *Plugin) Ready() (*status.Status, error) {
+	state := p.snapshot()
+
+	if state.client == nil || !state.client.Connected() || !state.declared {
+		return &status.Status{Code: http.StatusServiceUnavailable}, nil
+	}
+
+	for _, cfg := range p.cfg.Consumers {
+		c := state.consumerOf(cfg)
+		if c != nil && c.amqp.Paused() {
+			continue
+		}
+		if c == nil || !c.amqp.ChannelOpen() || !c.amqp.Forwarding() {
+			return &status.Status{Code: http.StatusServiceUnavailable}, nil
+		}
+
+		wp, ok := state.pools[cfg.Pool]
+		if !ok || !wp.hasActiveWorker() {
+			return &status.Status{Code: http.StatusServiceUnavailable}, nil
+		}
+	}
+
+	return &status.Status{Code: http.StatusOK}, nil
+}
+
+// consumerOf returns the running consumer of the config
+func (s *pluginState) consumerOf(cfg *ConsumerConfig) *consumer {
+	for _, c := range s.consumers {
+		if c.cfg == cfg {
+			return c
+		}
+	}
+
+	return nil
+}
+
+// hasActiveWorker reports whether a worker is ready or working
+func (w *Worker) hasActiveWorker() bool {
+	for _, process := range w.pool.Workers() {
+		state := process.State().CurrentState()
+		if state == fsm.StateReady || state == fsm.StateWorking {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,208 @@
+package thumper
+
+import (
+	"context"
+	"github.com/dstrop/thumper/amqp"
+	"github.com/roadrunner-server/pool/fsm"
+	"go.uber.org/zap"
+	"net/http"
+	"testing"
+	"time"
+)
+
+type testConnection struct {
+	connected bool
+	idle      int
+}
+
+func (c *testConnection) Connected() bool {
+	return c.connected
+}
+
+func (c *testConnection) IdleChannels() int {
+	return c.idle
+}
+
+// testConsumer is a broker consumer in a fixed state
+type testConsumer struct {
+	tag         string
+	delivered   uint64
+	channelOpen bool
+	paused      bool
+	forwarding  bool
+}
+
+func (c *testConsumer) Consume() error                         { return nil }
+func (c *testConsumer) Deliveries() <-chan amqp.Delivery       { return nil }
+func (c *testConsumer) Delivered() uint64                      { return c.delivered }
+func (c *testConsumer) Tag() string                            { return c.tag }
+func (c *testConsumer) State() (amqp.ConsumerState, time.Time) { return amqp.StateActive, time.Time{} }
+func (c *testConsumer) Pause() error                           { return nil }
+func (c *testConsumer) Resume() error                          { return nil }
+func (c *testConsumer) Paused() bool                           { return c.paused }
+func (c *testConsumer) WaitCancelled(context.Context) error    { return nil }
+func (c *testConsumer) Forwarding() bool                       { return c.forwarding }
+func (c *testConsumer) ChannelOpen() bool                      { return c.channelOpen }
+func (c *testConsumer) Close() error                           { return nil }
+
+// testPlugin returns a plugin running the consumers of the config, all in the default pool
+func testPlugin(state *pluginState, consumers ...*consumer) *Plugin {
+	p := &Plugin{cfg: &Config{}, log: zap.NewNop()}
+	for _, c := range consumers {
+		p.cfg.Consumers = append(p.cfg.Consumers, c.cfg)
+	}
+
+	state.consumers = consumers
+	p.state.Store(state)
+
+	return p
+}
+
+func testConsumerOf(queue string, amqp *testConsumer) *consumer {
+	return &consumer{cfg: &ConsumerConfig{Queue: queue}, amqp: amqp}
+}
+
+func runningConsumer() *testConsumer {
+	return &testConsumer{channelOpen: true, forwarding: true}
+}
+
+func TestStatus(t *testing.T) {
+	tests := []struct {
+		name      string
+		client    connection
+		consumers []*testConsumer
+		workers   []int64
+		code      int
+	}{
+		{name: "not connected yet", workers: []int64{fsm.StateReady}, code: http.StatusOK},
+		{name: "healthy", client: &testConnection{connected: true}, consumers: []*testConsumer{runningConsumer()}, workers: []int64{fsm.StateWorking}, code: http.StatusOK},
+		{name: "reconnecting", client: &testConnection{}, workers: []int64{fsm.StateReady}, code: http.StatusServiceUnavailable},
+		{
+			name:      "consumer channel reopening",
+			client:    &testConnection{connected: true},
+			consumers: []*testConsumer{runningConsumer(), {}},
+			workers:   []int64{fsm.StateReady},
+			code:      http.StatusServiceUnavailable,
+		},
+		{
+			name:      "paused consumer",
+			client:    &testConnection{connected: true},
+			consumers: []*testConsumer{{channelOpen: true, paused: true}},
+			workers:   []int64{fsm.StateReady},
+			code:      http.StatusOK,
+		},
+		{name: "no active worker", client: &testConnection{connected: true}, workers: []int64{fsm.StateInactive}, code: http.StatusServiceUnavailable},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var consumers []*consumer
+			for _, c := range tt.consumers {
+				consumers = append(consumers, testConsumerOf("orders", c))
+			}
+			state := &pluginState{
+				client: tt.client,
+				pools:  map[string]*Worker{"": {pool: testPoolWorkers(t, tt.workers...)}},
+			}
+
+			st, err := testPlugin(state, consumers...).Status()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if st.Code != tt.code {
+				t.Errorf("status %d, expected %d", st.Code, tt.code)
+			}
+		})
+	}
+}
+
+func TestReady(t *testing.T) {
+	tests := []struct {
+		name      string
+		client    connection
+		declared  bool
+		consumers []*testConsumer
+		workers   []int64
+		code      int
+	}{
+		{name: "not connected", workers: []int64{fsm.StateReady}, code: http.StatusServiceUnavailable},
+		{name: "reconnecting", client: &testConnection{}, declared: true, code: http.StatusServiceUnavailable},
+		{name: "not declared", client: &testConnection{connected: true}, code: http.StatusServiceUnavailable},
+		{name: "publisher", client: &testConnection{connected: true}, declared: true, code: http.StatusOK},
+		{
+			name:      "consumers running",
+			client:    &testConnection{connected: true},
+			declared:  true,
+			consumers: []*testConsumer{runningConsumer(), runningConsumer()},
+			workers:   []int64{fsm.StateReady},
+			code:      http.StatusOK,
+		},
+		{
+			name:      "paused consumer",
+			client:    &testConnection{connected: true},
+			declared:  true,
+			consumers: []*testConsumer{runningConsumer(), {channelOpen: true, paused: true}},
+			workers:   []int64{fsm.StateReady},
+			code:      http.StatusOK,
+		},
+		{
+			name:      "consumer not forwarding",
+			client:    &testConnection{connected: true},
+			declared:  true,
+			consumers: []*testConsumer{runningConsumer(), {channelOpen: true}},
+			workers:   []int64{fsm.StateReady},
+			code:      http.StatusServiceUnavailable,
+		},
+		{
+			name:      "consumer channel closed",
+			client:    &testConnection{connected: true},
+			declared:  true,
+			consumers: []*testConsumer{{forwarding: true}},
+			workers:   []int64{fsm.StateReady},
+			code:      http.StatusServiceUnavailable,
+		},
+		{
+			name:      "no active worker",
+			client:    &testConnection{connected: true},
+			declared:  true,
+			consumers: []*testConsumer{runningConsumer()},
+			workers:   []int64{fsm.StateStopped},
+			code:      http.StatusServiceUnavailable,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var consumers []*consumer
+			for _, c := range tt.consumers {
+				consumers = append(consumers, testConsumerOf("orders", c))
+			}
+			state := &pluginState{
+				client:   tt.client,
+				declared: tt.declared,
+				pools:    map[string]*Worker{"": {pool: testPoolWorkers(t, tt.workers...)}},
+			}
+
+			st, err := testPlugin(state, consumers...).Ready()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if st.Code != tt.code {
+				t.Errorf("status %d, expected %d", st.Code, tt.code)
+			}
+		})
+	}
+}
+
+func TestReadyConsumerNotStarted(t *testing.T) {
+	p := testPlugin(&pluginState{client: &testConnection{connected: true}, declared: true})
+	p.cfg.Consumers = []*ConsumerConfig{{Queue: "orders"}}
+
+	st, err := p.Ready()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.Code != http.StatusServiceUnavailable {
+		t.Errorf("status %d, expected %d", st.Code, http.StatusServiceUnavailable)
+	}
+}
@@ -0,0 +1,316 @@
+package thumper
+
+import (
+	"fmt"
+	"github.com/dstrop/thumper/amqp"
+	"go.uber.org/zap"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	OffsetStoreFile  = "file"
+	OffsetStoreQueue = "queue"
+)
+
+// parseStreamOffset converts the configured start offset to the x-stream-offset argument value
+func parseStreamOffset(offset string) any {
+	switch offset {
+	case "", "next":
+		return "next"
+	case "first", "last":
+		return offset
+	}
+
+	if absolute, err := strconv.ParseInt(offset, 10, 64); err == nil {
+		return absolute
+	}
+
+	if timestamp, err := time.Parse(time.RFC3339, offset); err == nil {
+		return timestamp
+	}
+
+	// interval relative to now, e.g. 1D, 12h, 30m
+	return offset
+}
+
+// streamOffset returns the stream offset of the delivery
+func streamOffset(delivery *amqp.Delivery) (int64, bool) {
+	switch offset := delivery.Headers["x-stream-offset"].(type) {
+	case int64:
+		return offset, true
+	case int32:
+		return int64(offset), true
+	case int:
+		return int64(offset), true
+	default:
+		return 0, false
+	}
+}
+
+// offsetTracker tracks the last processed offset of a stream consumer.
+// Messages can finish out of order, the committed offset is the one below the oldest in-flight message.
+type offsetTracker struct {
+	cfg   *StreamConfig
+	store offsetStore
+	log   *zap.Logger
+
+	mu        sync.Mutex
+	inFlight  map[int64]struct{}
+	processed int64
+	// delivered is the last offset received on the current channel, -1 until there is one
+	delivered int64
+	// committed is -1 until there is a processed or stored offset
+	committed int64
+	flushed   int64
+
+	stopCh chan struct{}
+	doneCh chan struct{}
+}
+
+func newOffsetTracker(cfg *StreamConfig, store offsetStore, log *zap.Logger) *offsetTracker {
+	return &offsetTracker{
+		cfg:       cfg,
+		store:     store,
+		log:       log,
+		inFlight:  make(map[int64]struct{}),
+		processed: -1,
+		delivered: -1,
+		committed: -1,
+		flushed:   -1,
+		stopCh:    make(chan struct{}),
+		doneCh:    make(chan struct{}),
+	}
+}
+
+// load reads the stored offset and starts periodic flushing
+func (t *offsetTracker) load() error {
+	if t.store != nil {
+		offset, ok, err := t.store.Load()
+		if err != nil {
+			return fmt.Errorf("failed to load stream offset: %w", err)
+		}
+		if ok {
+			t.processed = offset
+			t.delivered = offset
+			t.committed = offset
+			t.flushed = offset
+		}
+	}
+
+	go t.flushLoop()
+
+	return nil
+}
+
+// args returns the consume arguments. On a new channel the messages in flight are redelivered,
+// so it resumes after the committed offset when there is one. A consumer resumed on the same channel
+// continues after the last delivered offset and the messages in flight are still tracked.
+func (t *offsetTracker) args(base map[string]interface{}, resumed bool) amqp.Table {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	args := make(amqp.Table, len(base)+1)
+	for key, value := range base {
+		args[key] = value
+	}
+
+	if resumed && t.delivered >= 0 {
+		args["x-stream-offset"] = t.delivered + 1
+		return args
+	}
+
+	if t.committed >= 0 {
+		args["x-stream-offset"] = t.committed + 1
+	} else {
+		args["x-stream-offset"] = parseStreamOffset(t.cfg.Offset)
+	}
+
+	// messages still in flight from the previous channel are redelivered
+	t.inFlight = make(map[int64]struct{})
+	t.processed = t.committed
+	t.delivered = t.committed
+
+	return args
+}
+
+func (t *offsetTracker) begin(offset int64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.inFlight[offset] = struct{}{}
+	if offset > t.delivered {
+		t.delivered = offset
+	}
+}
+
+func (t *offsetTracker) done(offset int64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if _, ok := t.inFlight[offset]; !ok {
+		return
+	}
+	delete(t.inFlight, offset)
+
+	if offset > t.processed {
+		t.processed = offset
+	}
+
+	committed := t.processed
+	for inFlight := range t.inFlight {
+		if inFlight <= committed {
+			committed = inFlight - 1
+		}
+	}
+	if committed > t.committed {
+		t.committed = committed
+	}
+}
+
+func (t *offsetTracker) flushLoop() {
+	defer close(t.doneCh)
+
+	if t.store == nil {
+		return
+	}
+
+	ticker := time.NewTicker(t.cfg.FlushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			t.flush()
+		case <-t.stopCh:
+			t.flush()
+			return
+		}
+	}
+}
+
+func (t *offsetTracker) flush() {
+	t.mu.Lock()
+	committed := t.committed
+	t.mu.Unlock()
+
+	if committed < 0 || committed == t.flushed {
+		return
+	}
+
+	err := t.store.Store(committed)
+	if err != nil {
+		t.log.Error("failed to store stream offset", zap.Int64("offset", committed), zap.Error(err))
+		return
+	}
+	t.flushed = committed
+}
+
+// stop flushes the committed offset and stops flushing
+func (t *offsetTracker) stop() {
+	select {
+	case <-t.stopCh:
+	default:
+		close(t.stopCh)
+	}
+	<-t.doneCh
+}
+
+type offsetStore interface {
+	Load() (int64, bool, error)
+	Store(offset int64) error
+}
+
+func newOffsetStore(cfg *StreamConfig, client *amqp.Client) (offsetStore, error) {
+	switch cfg.OffsetStore {
+	case "":
+		return nil, nil
+	case OffsetStoreFile:
+		return &fileOffsetStore{path: cfg.OffsetFile}, nil
+	case OffsetStoreQueue:
+		err := client.DeclareQueue(cfg.OffsetQueue, true, false, false, false, amqp.Table{
+			"x-max-length": int64(1),
+			"x-overflow":   "drop-head",
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to declare offset queue %s: %w", cfg.OffsetQueue, err)
+		}
+		return &queueOffsetStore{client: client, queue: cfg.OffsetQueue}, nil
+	default:
+		return nil, fmt.Errorf("unknown offset store %s", cfg.OffsetStore)
+	}
+}
+
+// fileOffsetStore keeps the offset in a local file
+type fileOffsetStore struct {
+	path string
+}
+
+func (s *fileOffsetStore) Load() (int64, bool, error) {
+	data, err := os.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, err
+	}
+
+	offset, err := strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64)
+	if err != nil {
+		return 0, false, fmt.Errorf("malformed offset file %s: %w", s.path, err)
+	}
+
+	return offset, true, nil
+}
+
+func (s *fileOffsetStore) Store(offset int64) error {
+	err := os.MkdirAll(filepath.Dir(s.path), 0o755)
+	if err != nil {
+		return err
+	}
+
+	// write and rename, so the file is never left half written
+	tmp := s.path + ".tmp"
+	err = os.WriteFile(tmp, []byte(strconv.FormatInt(offset, 10)), 0o644)
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, s.path)
+}
+
+// queueOffsetStore keeps the offset on the broker, in a queue holding only the last published offset
+type queueOffsetStore struct {
+	client *amqp.Client
+	queue  string
+}
+
+// Load reads the offset message and republishes it before acking it, so the offset is never lost,
+// even when the instance dies while loading. The queue is still empty between the get and the republish,
+// so loads of the same offset queue from several instances at once race, a stream consumer using the queue store
+// must run on a single active instance, the other instances take over only after it stops.
+func (s *queueOffsetStore) Load() (int64, bool, error) {
+	var offset int64
+	_, ok, err := s.client.Replace(s.queue, func(body []byte) ([]byte, error) {
+		var err error
+		offset, err = strconv.ParseInt(string(body), 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("malformed offset in queue %s: %w", s.queue, err)
+		}
+
+		return body, nil
+	})
+	if err != nil || !ok {
+		return 0, false, err
+	}
+
+	return offset, true, nil
+}
+
+func (s *queueOffsetStore) Store(offset int64) error {
+	return s.client.Publish("", s.queue, false, false, "text/plain", "", []byte(strconv.FormatInt(offset, 10)), nil)
+}
@@ -0,0 +1,176 @@
+package thumper
+
+import (
+	"github.com/dstrop/thumper/amqp"
+	amqp091 "github.com/rabbitmq/amqp091-go"
+	"go.uber.org/zap"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestParseStreamOffset(t *testing.T) {
+	timestamp := "2024-05-01T10:00:00Z"
+	parsed, _ := time.Parse(time.RFC3339, timestamp)
+
+	tests := []struct {
+		offset string
+		want   any
+	}{
+		{"", "next"},
+		{"next", "next"},
+		{"first", "first"},
+		{"last", "last"},
+		{"42", int64(42)},
+		{timestamp, parsed},
+		{"1D", "1D"},
+		{"12h", "12h"},
+	}
+
+	for _, tt := range tests {
+		if got := parseStreamOffset(tt.offset); got != tt.want {
+			t.Errorf("parseStreamOffset(%q) = %v (%T), expected %v (%T)", tt.offset, got, got, tt.want, tt.want)
+		}
+	}
+}
+
+func TestStreamOffset(t *testing.T) {
+	tests := []struct {
+		header any
+		want   int64
+		ok     bool
+	}{
+		{int64(7), 7, true},
+		{int32(7), 7, true},
+		{7, 7, true},
+		{"7", 0, false},
+		{nil, 0, false},
+	}
+
+	for _, tt := range tests {
+		delivery := &amqp.Delivery{Delivery: amqp091.Delivery{Headers: amqp091.Table{"x-stream-offset": tt.header}}}
+		got, ok := streamOffset(delivery)
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("streamOffset(%#v) = %d, %t, expected %d, %t", tt.header, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestOffsetTrackerCommit(t *testing.T) {
+	tests := []struct {
+		name  string
+		begin []int64
+		done  []int64
+		want  int64
+	}{
+		{name: "nothing processed", begin: []int64{0, 1}, want: -1},
+		{name: "in order", begin: []int64{0, 1, 2}, done: []int64{0, 1, 2}, want: 2},
+		{name: "oldest in flight", begin: []int64{0, 1, 2}, done: []int64{1, 2}, want: -1},
+		{name: "gap in flight", begin: []int64{0, 1, 2, 3}, done: []int64{0, 2, 3}, want: 0},
+		{name: "out of order", begin: []int64{5, 6, 7}, done: []int64{7, 6, 5}, want: 7},
+		{name: "unknown offset", begin: []int64{0}, done: []int64{3}, want: -1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tracker := newOffsetTracker(&StreamConfig{}, nil, zap.NewNop())
+			for _, offset := range tt.begin {
+				tracker.begin(offset)
+			}
+			for _, offset := range tt.done {
+				tracker.done(offset)
+			}
+
+			if tracker.committed != tt.want {
+				t.Errorf("committed %d, expected %d", tracker.committed, tt.want)
+			}
+		})
+	}
+}
+
+func TestOffsetTrackerArgs(t *testing.T) {
+	tracker := newOffsetTracker(&StreamConfig{Offset: "first"}, nil, zap.NewNop())
+
+	args := tracker.args(map[string]interface{}{"x-priority": 1}, false)
+	if args["x-stream-offset"] != "first" || args["x-priority"] != 1 {
+		t.Errorf("unexpected args %v", args)
+	}
+
+	// nothing was delivered yet
+	args = tracker.args(nil, true)
+	if args["x-stream-offset"] != "first" {
+		t.Errorf("resumed from %v, expected first", args["x-stream-offset"])
+	}
+}
+
+func TestOffsetTrackerResume(t *testing.T) {
+	tests := []struct {
+		name      string
+		resumed   bool
+		offset    int64
+		committed int64
+	}{
+		// 11 and 12 are redelivered on the new channel
+		{name: "redial", offset: 11, committed: 10},
+		// 11 and 12 are still processed, their completion is tracked
+		{name: "resume", resumed: true, offset: 13, committed: 12},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tracker := newOffsetTracker(&StreamConfig{Offset: "first"}, nil, zap.NewNop())
+			tracker.args(nil, false)
+
+			tracker.begin(10)
+			tracker.begin(11)
+			tracker.begin(12)
+			tracker.done(10)
+
+			args := tracker.args(nil, tt.resumed)
+			if args["x-stream-offset"] != tt.offset {
+				t.Errorf("consumed from %v, expected %d", args["x-stream-offset"], tt.offset)
+			}
+
+			tracker.done(12)
+			tracker.done(11)
+			if tracker.committed != tt.committed {
+				t.Errorf("committed %d, expected %d", tracker.committed, tt.committed)
+			}
+		})
+	}
+}
+
+func TestOffsetTrackerFlush(t *testing.T) {
+	store := &fileOffsetStore{path: filepath.Join(t.TempDir(), "consumer.offset")}
+	err := store.Store(41)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tracker := newOffsetTracker(&StreamConfig{FlushInterval: time.Hour}, store, zap.NewNop())
+	err = tracker.load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if args := tracker.args(nil, false); args["x-stream-offset"] != int64(42) {
+		t.Errorf("resumed from %v, expected 42", args["x-stream-offset"])
+	}
+
+	tracker.begin(42)
+	tracker.done(42)
+	tracker.stop()
+
+	offset, ok, err := store.Load()
+	if err != nil || !ok || offset != 42 {
+		t.Errorf("stored offset %d, %t, %v, expected 42", offset, ok, err)
+	}
+}
+
+func TestFileOffsetStoreMissing(t *testing.T) {
+	store := &fileOffsetStore{path: filepath.Join(t.TempDir(), "missing.offset")}
+
+	_, ok, err := store.Load()
+	if err != nil || ok {
+		t.Errorf("expected no offset, got %t, %v", ok, err)
+	}
+}
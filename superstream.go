@@ -0,0 +1,84 @@
+package thumper
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math/bits"
+	"strconv"
+)
+
+// superStreamSeed is the murmur3 seed used by the RabbitMQ stream clients,
+// using the same hash keeps partitioning compatible with other publishers
+const superStreamSeed = 104729
+
+func (c *SuperStreamConfig) partitionName(partition int) string {
+	return c.Name + "-" + strconv.Itoa(partition)
+}
+
+// route returns the routing key of the partition for the message
+func (c *SuperStreamConfig) route(message *Message) (string, error) {
+	if c.Partitions <= 0 {
+		return "", fmt.Errorf("super stream %s has no partitions", c.Name)
+	}
+
+	value := message.Key
+	if c.RoutingHeader != "" {
+		header, ok := message.Headers[c.RoutingHeader]
+		if !ok {
+			return "", fmt.Errorf("missing super stream routing header %s", c.RoutingHeader)
+		}
+		value = fmt.Sprint(header)
+	}
+
+	partition := murmur3([]byte(value), superStreamSeed) % uint32(c.Partitions)
+
+	return strconv.FormatUint(uint64(partition), 10), nil
+}
+
+// murmur3 is the 32-bit MurmurHash3
+func murmur3(data []byte, seed uint32) uint32 {
+	const (
+		c1 = 0xcc9e2d51
+		c2 = 0x1b873593
+	)
+
+	h := seed
+	n := len(data) / 4
+
+	for i := 0; i < n; i++ {
+		k := binary.LittleEndian.Uint32(data[i*4:])
+		k *= c1
+		k = bits.RotateLeft32(k, 15)
+		k *= c2
+
+		h ^= k
+		h = bits.RotateLeft32(h, 13)
+		h = h*5 + 0xe6546b64
+	}
+
+	tail := data[n*4:]
+	var k uint32
+	switch len(tail) {
+	case 3:
+		k ^= uint32(tail[2]) << 16
+		fallthrough
+	case 2:
+		k ^= uint32(tail[1]) << 8
+		fallthrough
+	case 1:
+		k ^= uint32(tail[0])
+		k *= c1
+		k = bits.RotateLeft32(k, 15)
+		k *= c2
+		h ^= k
+	}
+
+	h ^= uint32(len(data))
+	h ^= h >> 16
+	h *= 0x85ebca6b
+	h ^= h >> 13
+	h *= 0xc2b2ae35
+	h ^= h >> 16
+
+	return h
+}
@@ -0,0 +1,96 @@
+package thumper
+
+import (
+	"strconv"
+	"testing"
+)
+
+// the partitions of the hash routing tests of rabbitmq-stream-go-client (pkg/stream/super_stream_producer_test.go)
+func TestSuperStreamRouteReference(t *testing.T) {
+	tests := []struct {
+		key       string
+		partition int
+	}{
+		{"hello1", 1},
+		{"hello2", 0},
+		{"hello3", 1},
+		{"hello4", 2},
+		{"hello5", 0},
+		{"hello6", 2},
+		{"hello7", 0},
+		{"hello8", 1},
+		{"hello9", 0},
+		{"hello10", 2},
+		{"hello88", 1},
+	}
+
+	cfg := &SuperStreamConfig{Name: "invoices", Partitions: 3}
+	for _, tt := range tests {
+		got, err := cfg.route(&Message{Key: tt.key})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != strconv.Itoa(tt.partition) {
+			t.Errorf("key %q routed to %s, expected %d", tt.key, got, tt.partition)
+		}
+	}
+}
+
+// hashes computed with github.com/spaolacci/murmur3, used by rabbitmq-stream-go-client, seeded with 104729
+func TestMurmur3(t *testing.T) {
+	tests := []struct {
+		key        string
+		hash       uint32
+		partitions map[int]int
+	}{
+		{"", 3329588566, map[int]int{2: 0, 5: 1, 7: 3}},
+		{"a", 1086686554, map[int]int{2: 0, 5: 4, 7: 2}},
+		{"ab", 398604456, map[int]int{2: 0, 5: 1, 7: 5}},
+		{"abc", 3409700625, map[int]int{2: 1, 5: 0, 7: 2}},
+		{"abcd", 3421720556, map[int]int{2: 0, 5: 1, 7: 2}},
+		{"order-1", 828619386, map[int]int{2: 0, 5: 1, 7: 0}},
+		{"order-42", 556465915, map[int]int{2: 1, 5: 0, 7: 5}},
+		{"customer-7f3a", 3242554582, map[int]int{2: 0, 5: 2, 7: 1}},
+		{"žluťoučký kůň", 182626855, map[int]int{2: 1, 5: 0, 7: 5}},
+		{"hello88", 800525683, map[int]int{2: 1, 5: 3, 7: 6}},
+	}
+
+	for _, tt := range tests {
+		if got := murmur3([]byte(tt.key), superStreamSeed); got != tt.hash {
+			t.Errorf("murmur3(%q) = %d, expected %d", tt.key, got, tt.hash)
+		}
+
+		for partitions, partition := range tt.partitions {
+			cfg := &SuperStreamConfig{Name: "orders", Partitions: partitions}
+			got, err := cfg.route(&Message{Key: tt.key})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != strconv.Itoa(partition) {
+				t.Errorf("key %q routed to %s of %d partitions, expected %d", tt.key, got, partitions, partition)
+			}
+		}
+	}
+}
+
+func TestSuperStreamRouteHeader(t *testing.T) {
+	cfg := &SuperStreamConfig{Name: "orders", Partitions: 5, RoutingHeader: "x-order-id"}
+
+	got, err := cfg.route(&Message{Key: "ignored", Headers: map[string]interface{}{"x-order-id": "order-42"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != "0" {
+		t.Errorf("routed to %s, expected 0", got)
+	}
+
+	_, err = cfg.route(&Message{Key: "order-42"})
+	if err == nil {
+		t.Error("expected an error for a missing routing header")
+	}
+
+	_, err = (&SuperStreamConfig{Name: "orders"}).route(&Message{Key: "order-42"})
+	if err == nil {
+		t.Error("expected an error without partitions")
+	}
+}
@@ -0,0 +1,178 @@
+package thumper
+
+import (
+	"context"
+	"github.com/dstrop/thumper/amqp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const tracerName = "github.com/dstrop/thumper"
+
+// outcomeKey is the attribute recording how a processed message was settled
+const outcomeKey = attribute.Key("thumper.outcome")
+
+const (
+	outcomeAck        = "ack"
+	outcomeRequeue    = "requeue"
+	outcomeReject     = "reject"
+	outcomeDeadLetter = "dead_letter"
+	// outcomeAutoAck is recorded when the broker settled the message on delivery
+	outcomeAutoAck = "auto_ack"
+)
+
+// propagator reads and writes W3C traceparent, tracestate and baggage headers
+var propagator = propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{})
+
+// headerCarrier adapts message headers to propagation.TextMapCarrier
+type headerCarrier map[string]any
+
+func (c headerCarrier) Get(key string) string {
+	switch value := c[key].(type) {
+	case string:
+		return value
+	case []byte:
+		return string(value)
+	default:
+		return ""
+	}
+}
+
+func (c headerCarrier) Set(key, value string) {
+	c[key] = value
+}
+
+func (c headerCarrier) Keys() []string {
+	keys := make([]string, 0, len(c))
+	for key := range c {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+// startPublishSpan starts a producer span continuing the trace context in the headers
+// and injects the span context into the headers
+func startPublishSpan(exchange, key string, headers map[string]any, size int) trace.Span {
+	ctx := propagator.Extract(context.Background(), headerCarrier(headers))
+
+	destination := exchange
+	if destination == "" {
+		destination = "amq.default"
+	}
+
+	ctx, span := otel.Tracer(tracerName).Start(ctx, "publish "+destination,
+		trace.WithSpanKind(trace.SpanKindProducer),
+		trace.WithAttributes(
+			semconv.MessagingSystemRabbitmq,
+			semconv.MessagingOperationTypePublish,
+			semconv.MessagingOperationName("publish"),
+			semconv.MessagingDestinationName(exchange),
+			semconv.MessagingRabbitmqDestinationRoutingKey(key),
+			semconv.MessagingMessageBodySize(size),
+		),
+	)
+
+	if span.SpanContext().IsValid() {
+		propagator.Inject(ctx, headerCarrier(headers))
+	}
+
+	return span
+}
+
+// startProcessSpan starts a consumer span continuing the trace context of the delivery
+func startProcessSpan(delivery *amqp.Delivery, queue string) (context.Context, trace.Span) {
+	ctx := propagator.Extract(context.Background(), headerCarrier(delivery.Headers))
+
+	return otel.Tracer(tracerName).Start(ctx, "process "+queue,
+		trace.WithSpanKind(trace.SpanKindConsumer),
+		trace.WithAttributes(
+			semconv.MessagingSystemRabbitmq,
+			semconv.MessagingOperationTypeDeliver,
+			semconv.MessagingOperationName("process"),
+			semconv.MessagingDestinationName(queue),
+			semconv.MessagingRabbitmqDestinationRoutingKey(delivery.RoutingKey),
+			semconv.MessagingRabbitmqMessageDeliveryTag(int(delivery.DeliveryTag)),
+			semconv.MessagingMessageID(delivery.MessageId),
+			semconv.MessagingMessageConversationID(delivery.CorrelationId),
+			semconv.MessagingMessageBodySize(len(delivery.Body)),
+		),
+	)
+}
+
+// startBatchSpan starts a consumer span of a batch, linked to the trace context of each message
+func startBatchSpan(messages []*message, queue string) (context.Context, trace.Span) {
+	links := make([]trace.Link, 0, len(messages))
+	for _, msg := range messages {
+		ctx := propagator.Extract(context.Background(), headerCarrier(msg.delivery.Headers))
+		if spanContext := trace.SpanContextFromContext(ctx); spanContext.IsValid() {
+			links = append(links, trace.Link{SpanContext: spanContext})
+		}
+	}
+
+	return otel.Tracer(tracerName).Start(context.Background(), "process "+queue,
+		trace.WithSpanKind(trace.SpanKindConsumer),
+		trace.WithLinks(links...),
+		trace.WithAttributes(
+			semconv.MessagingSystemRabbitmq,
+			semconv.MessagingOperationTypeDeliver,
+			semconv.MessagingOperationName("process"),
+			semconv.MessagingDestinationName(queue),
+			semconv.MessagingBatchMessageCount(len(messages)),
+		),
+	)
+}
+
+// traceContext returns the W3C headers of the span context, they are passed to the worker
+func traceContext(ctx context.Context) map[string]string {
+	if !trace.SpanContextFromContext(ctx).IsValid() {
+		return nil
+	}
+
+	carrier := propagation.MapCarrier{}
+	propagator.Inject(ctx, carrier)
+
+	return carrier
+}
+
+func spanFailed(span trace.Span, description string, err error) {
+	if span == nil {
+		return
+	}
+
+	span.RecordError(err)
+	span.SetStatus(codes.Error, description)
+}
+
+// spanSettled records the outcome of the message as an attribute of its span,
+// or as a settle event with the delivery tag on the span of its batch
+func spanSettled(msg *message, outcome string) {
+	if msg.span == nil {
+		return
+	}
+
+	if msg.batched {
+		msg.span.AddEvent("settle", trace.WithAttributes(
+			outcomeKey.String(outcome),
+			semconv.MessagingRabbitmqMessageDeliveryTag(int(msg.delivery.DeliveryTag)),
+		))
+		return
+	}
+
+	msg.span.SetAttributes(outcomeKey.String(outcome))
+}
+
+// resultOutcome returns the outcome of the worker result
+func resultOutcome(result byte) string {
+	switch result {
+	case Nack:
+		return outcomeRequeue
+	case Reject:
+		return outcomeReject
+	default:
+		return outcomeAck
+	}
+}
@@ -0,0 +1,227 @@
+package thumper
+
+import (
+	"encoding/json"
+	"github.com/dstrop/thumper/amqp"
+	amqp091 "github.com/rabbitmq/amqp091-go"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
+	"strings"
+	"testing"
+	"time"
+)
+
+const (
+	testTraceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+	testSpanID  = "00f067aa0ba902b7"
+	// testTraceparent is the W3C trace context of a sampled span of the producer
+	testTraceparent = "00-" + testTraceID + "-" + testSpanID + "-01"
+)
+
+// recordSpans records the spans ended during the test
+func recordSpans(t *testing.T) *tracetest.SpanRecorder {
+	recorder := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+
+	previous := otel.GetTracerProvider()
+	otel.SetTracerProvider(provider)
+	t.Cleanup(func() {
+		otel.SetTracerProvider(previous)
+		_ = provider.Shutdown(t.Context())
+	})
+
+	return recorder
+}
+
+// traceparent returns the W3C trace context of the span
+func traceparent(span sdktrace.ReadOnlySpan) string {
+	return "00-" + span.SpanContext().TraceID().String() + "-" + span.SpanContext().SpanID().String() + "-01"
+}
+
+// recordingSpan records the attributes and events set on the span
+type recordingSpan struct {
+	noop.Span
+	attributes []attribute.KeyValue
+	events     map[string][]attribute.KeyValue
+}
+
+func (s *recordingSpan) SetAttributes(kv ...attribute.KeyValue) {
+	s.attributes = append(s.attributes, kv...)
+}
+
+func (s *recordingSpan) AddEvent(name string, options ...trace.EventOption) {
+	if s.events == nil {
+		s.events = make(map[string][]attribute.KeyValue)
+	}
+	config := trace.NewEventConfig(options...)
+	s.events[name] = append(s.events[name], config.Attributes()...)
+}
+
+func attributeValue(attributes []attribute.KeyValue, key attribute.Key) (attribute.Value, bool) {
+	for _, kv := range attributes {
+		if kv.Key == key {
+			return kv.Value, true
+		}
+	}
+
+	return attribute.Value{}, false
+}
+
+func TestSpanSettled(t *testing.T) {
+	tests := []struct {
+		name    string
+		batched bool
+		outcome string
+	}{
+		{name: "message", outcome: outcomeAck},
+		{name: "dead-lettered message", outcome: outcomeDeadLetter},
+		{name: "batched message", batched: true, outcome: outcomeRequeue},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			span := &recordingSpan{}
+			msg := &message{
+				delivery: &amqp.Delivery{Delivery: amqp091.Delivery{DeliveryTag: 7}},
+				span:     span,
+				batched:  tt.batched,
+			}
+
+			spanSettled(msg, tt.outcome)
+
+			attributes := span.attributes
+			if tt.batched {
+				if len(span.attributes) != 0 {
+					t.Errorf("batch span attributes %v, expected a settle event", span.attributes)
+				}
+				attributes = span.events["settle"]
+
+				tag, ok := attributeValue(attributes, "messaging.rabbitmq.message.delivery_tag")
+				if !ok || tag.AsInt64() != 7 {
+					t.Errorf("delivery tag %v, expected 7", tag.Emit())
+				}
+			}
+
+			outcome, ok := attributeValue(attributes, outcomeKey)
+			if !ok || outcome.AsString() != tt.outcome {
+				t.Errorf("outcome %q, expected %q", outcome.AsString(), tt.outcome)
+			}
+		})
+	}
+}
+
+func TestSpanSettledWithoutSpan(t *testing.T) {
+	spanSettled(&message{}, outcomeAck)
+}
+
+func TestResultOutcome(t *testing.T) {
+	tests := []struct {
+		result  byte
+		outcome string
+	}{
+		{result: Ack, outcome: outcomeAck},
+		{result: Nack, outcome: outcomeRequeue},
+		{result: Reject, outcome: outcomeReject},
+	}
+
+	for _, tt := range tests {
+		if outcome := resultOutcome(tt.result); outcome != tt.outcome {
+			t.Errorf("result %c: outcome %q, expected %q", tt.result, outcome, tt.outcome)
+		}
+	}
+}
+
+func TestPublishInjectsTraceContext(t *testing.T) {
+	tests := []struct {
+		name    string
+		headers map[string]any
+		parent  string
+	}{
+		{name: "new trace"},
+		{name: "continued trace", headers: map[string]any{"traceparent": testTraceparent}, parent: testSpanID},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			recorder := recordSpans(t)
+			client := &testPublisher{}
+			r := &rpc{plugin: &Plugin{cfg: &Config{Amqp: &AmqpConfig{}}}}
+
+			err := r.publish(client, &Message{Exchange: "orders", Key: "orders.created", Message: "{}", Headers: tt.headers})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			spans := recorder.Ended()
+			if len(spans) != 1 || len(client.published) != 1 {
+				t.Fatalf("%d spans and %d published messages, expected 1", len(spans), len(client.published))
+			}
+			span := spans[0]
+			if span.Name() != "publish orders" || span.SpanKind() != trace.SpanKindProducer {
+				t.Errorf("span %s of kind %s", span.Name(), span.SpanKind())
+			}
+			if tt.parent == "" && span.Parent().IsValid() {
+				t.Errorf("span has parent %s, expected a new trace", span.Parent().SpanID())
+			}
+			if tt.parent != "" && (span.Parent().SpanID().String() != tt.parent || span.SpanContext().TraceID().String() != testTraceID) {
+				t.Errorf("span in trace %s with parent %s, expected %s and %s",
+					span.SpanContext().TraceID(), span.Parent().SpanID(), testTraceID, tt.parent)
+			}
+
+			if header := client.published[0].headers["traceparent"]; header != traceparent(span) {
+				t.Errorf("published traceparent %v, expected %s", header, traceparent(span))
+			}
+		})
+	}
+}
+
+func TestProcessSpanContinuesTrace(t *testing.T) {
+	recorder := recordSpans(t)
+	w := testWorker(&testPublisher{})
+
+	msg := &message{
+		consumer: &ConsumerConfig{Queue: "orders", ExecTimeout: time.Millisecond},
+		delivery: &amqp.Delivery{Delivery: amqp091.Delivery{
+			Acknowledger: &testAcknowledger{},
+			Headers:      amqp091.Table{"traceparent": testTraceparent},
+			RoutingKey:   "orders.created",
+			Body:         []byte("{}"),
+		}},
+	}
+	msg.consumer.InitDefaults()
+	w.doWork(msg)
+
+	spans := recorder.Ended()
+	if len(spans) != 1 {
+		t.Fatalf("%d spans, expected 1", len(spans))
+	}
+	span := spans[0]
+	if span.Name() != "process orders" || span.SpanKind() != trace.SpanKindConsumer {
+		t.Errorf("span %s of kind %s", span.Name(), span.SpanKind())
+	}
+	if span.SpanContext().TraceID().String() != testTraceID || span.Parent().SpanID().String() != testSpanID {
+		t.Errorf("span in trace %s with parent %s, expected %s and %s",
+			span.SpanContext().TraceID(), span.Parent().SpanID(), testTraceID, testSpanID)
+	}
+
+	// the worker continues the trace from the processing span
+	pool := w.pool.(*testPool)
+	if len(pool.payloads) != 1 {
+		t.Fatalf("%d executions, expected 1", len(pool.payloads))
+	}
+	var msgContext MessageContext
+	err := json.Unmarshal(pool.payloads[0].Context, &msgContext)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msgContext.Trace["traceparent"] != traceparent(span) {
+		t.Errorf("worker traceparent %s, expected %s", msgContext.Trace["traceparent"], traceparent(span))
+	}
+	if !strings.HasPrefix(msgContext.Trace["traceparent"], "00-"+testTraceID) {
+		t.Errorf("worker traceparent %s isn't in trace %s", msgContext.Trace["traceparent"], testTraceID)
+	}
+}
@@ -0,0 +1,304 @@
+package thumper
+
+import (
+	"fmt"
+	"github.com/go-viper/mapstructure/v2"
+	"sort"
+	"strings"
+)
+
+// configError lists every problem found in the configuration
+type configError struct {
+	problems []string
+}
+
+func (e *configError) Error() string {
+	return fmt.Sprintf("invalid configuration, %d problem(s):\n  %s", len(e.problems), strings.Join(e.problems, "\n  "))
+}
+
+type validator struct {
+	// prefix is prepended to the paths of the problems
+	prefix   string
+	problems []string
+}
+
+func (v *validator) add(path string, format string, args ...any) {
+	v.problems = append(v.problems, v.prefix+path+": "+fmt.Sprintf(format, args...))
+}
+
+// Validate checks the configuration after InitDefaults and ExpandEnv, it returns all problems at once
+func (c *Config) Validate() error {
+	v := &validator{prefix: pluginName + "."}
+
+	switch c.ResetMode {
+	case "", ResetQuiesce, ResetRolling:
+	default:
+		v.add("reset_mode", "unknown reset mode %s, expected quiesce or rolling", c.ResetMode)
+	}
+
+	if c.ShutdownTimeout < 0 {
+		v.add("shutdown_timeout", "must not be negative")
+	}
+
+	if c.Compression != nil {
+		switch c.Compression.Encoding {
+		case EncodingGzip, EncodingZstd, EncodingSnappy:
+		default:
+			v.add("compression.encoding", "unknown encoding %s, expected gzip, zstd or snappy", c.Compression.Encoding)
+		}
+		if c.Compression.Threshold < 0 {
+			v.add("compression.threshold", "must not be negative")
+		}
+	}
+
+	queues, exchanges := c.Amqp.validate(v)
+
+	consumerIDs := make(map[string]int, len(c.Consumers))
+	for i, consumer := range c.Consumers {
+		path := fmt.Sprintf("consumers[%d]", i)
+
+		if consumer.ConsumerID != "" {
+			if first, ok := consumerIDs[consumer.ConsumerID]; ok {
+				v.add(path+".consumer_id", "duplicate consumer id %s, already used by consumers[%d]", consumer.ConsumerID, first)
+			} else {
+				consumerIDs[consumer.ConsumerID] = i
+			}
+		}
+
+		switch {
+		case consumer.Pool == "" && c.Pool == nil:
+			v.add(path+".pool", "the default pool is not configured, configure pool or set the consumer pool")
+		case consumer.Pool != "" && c.Pools[consumer.Pool] == nil:
+			v.add(path+".pool", "unknown pool %s", consumer.Pool)
+		}
+
+		// the amq. exchanges are predeclared by the broker
+		if consumer.DeadLetter != nil && consumer.DeadLetter.Exchange != "" && !exchanges[consumer.DeadLetter.Exchange] &&
+			!strings.HasPrefix(consumer.DeadLetter.Exchange, "amq.") {
+			v.add(path+".dead_letter.exchange", "exchange %s is not declared in amqp.exchange or amqp.superStream", consumer.DeadLetter.Exchange)
+		}
+
+		consumer.validate(v, path, queues)
+	}
+
+	if len(v.problems) > 0 {
+		return &configError{problems: v.problems}
+	}
+
+	return nil
+}
+
+// validate returns the names of the declared queues and exchanges
+func (c *AmqpConfig) validate(v *validator) (map[string]bool, map[string]bool) {
+	queues := make(map[string]bool, len(c.Queue))
+	exchanges := make(map[string]bool, len(c.Exchange))
+
+	switch {
+	case c.Addr == "" && c.AddrFile == "":
+		v.add("amqp.addr", "addr or addr_file is required")
+	case c.Addr != "" && c.AddrFile != "":
+		v.add("amqp.addr_file", "can't be combined with addr")
+	}
+	if c.Username != "" && c.UsernameFile != "" {
+		v.add("amqp.username_file", "can't be combined with username")
+	}
+	if c.Password != "" && c.PasswordFile != "" {
+		v.add("amqp.password_file", "can't be combined with password")
+	}
+	_, err := c.URL()
+	if err != nil {
+		v.add("amqp", "%s", err)
+	}
+
+	for i, queue := range c.Queue {
+		path := fmt.Sprintf("amqp.queue[%d]", i)
+		switch {
+		case queue.Name == "":
+			v.add(path+".name", "is required")
+		case queues[queue.Name]:
+			v.add(path+".name", "duplicate queue %s", queue.Name)
+		}
+		queues[queue.Name] = true
+
+		_, err = queue.Arguments()
+		if err != nil {
+			v.add(path, "%s", err)
+		}
+	}
+
+	for i, exchange := range c.Exchange {
+		path := fmt.Sprintf("amqp.exchange[%d]", i)
+		switch {
+		case exchange.Name == "":
+			v.add(path+".name", "is required")
+		case exchanges[exchange.Name]:
+			v.add(path+".name", "duplicate exchange %s", exchange.Name)
+		}
+		exchanges[exchange.Name] = true
+
+		switch {
+		case exchange.Kind == "direct", exchange.Kind == "fanout", exchange.Kind == "topic", exchange.Kind == "headers":
+		// exchange types added by broker plugins, e.g. x-consistent-hash
+		case strings.HasPrefix(exchange.Kind, "x-"):
+		default:
+			v.add(path+".kind", "unknown exchange kind %q, expected direct, fanout, topic, headers or a plugin type (x-...)", exchange.Kind)
+		}
+	}
+
+	for i, superStream := range c.SuperStream {
+		path := fmt.Sprintf("amqp.superStream[%d]", i)
+		if superStream.Name == "" {
+			v.add(path+".name", "is required")
+		}
+		if superStream.Partitions <= 0 {
+			v.add(path+".partitions", "must be greater than 0")
+		}
+
+		exchanges[superStream.Name] = true
+		for partition := 0; partition < superStream.Partitions; partition++ {
+			queues[superStream.partitionName(partition)] = true
+		}
+	}
+
+	for i, queueBind := range c.QueueBind {
+		path := fmt.Sprintf("amqp.queueBind[%d]", i)
+		if !queues[queueBind.Queue] {
+			v.add(path+".queue", "queue %q is not declared in amqp.queue or amqp.superStream", queueBind.Queue)
+		}
+		// the amq. exchanges are predeclared by the broker
+		if !exchanges[queueBind.Exchange] && !strings.HasPrefix(queueBind.Exchange, "amq.") {
+			v.add(path+".exchange", "exchange %q is not declared in amqp.exchange or amqp.superStream", queueBind.Exchange)
+		}
+	}
+
+	return queues, exchanges
+}
+
+// validate checks the consumer, the queue must be declared in queues unless queues is nil
+func (c *ConsumerConfig) validate(v *validator, path string, queues map[string]bool) {
+	switch {
+	case c.Queue == "":
+		v.add(path+".queue", "is required")
+	case queues != nil && !queues[c.Queue]:
+		v.add(path+".queue", "queue %s is not declared in amqp.queue or amqp.superStream", c.Queue)
+	}
+
+	if c.Prefetch < 0 {
+		v.add(path+".prefetch", "must not be negative")
+	}
+	if c.Concurrency < 0 {
+		v.add(path+".concurrency", "must not be negative")
+	}
+	if c.Weight < 0 {
+		v.add(path+".weight", "must not be negative")
+	}
+	if c.MaxInFlight < 0 {
+		v.add(path+".max_in_flight", "must not be negative")
+	}
+	if c.ExecTimeout < 0 {
+		v.add(path+".exec_timeout", "must not be negative")
+	}
+	if c.MaxDecompressedSize < 0 {
+		v.add(path+".max_decompressed_size", "must not be negative")
+	}
+
+	_, err := contextCodec(c.Codec)
+	if err != nil {
+		v.add(path+".codec", "%s", err)
+	}
+
+	orderingKey, err := parseKeyExtractor(c.OrderingKey)
+	if err != nil {
+		v.add(path+".ordering_key", "%s", err)
+	}
+	keyed := orderingKey != nil
+
+	if c.KeyConcurrency != nil {
+		key, err := parseKeyExtractor(c.KeyConcurrency.Key)
+		switch {
+		case err != nil:
+			v.add(path+".key_concurrency.key", "%s", err)
+		case key == nil:
+			v.add(path+".key_concurrency.key", "is required")
+		}
+		if c.KeyConcurrency.Limit < 1 {
+			v.add(path+".key_concurrency.limit", "must be greater than 0")
+		}
+		keyed = true
+	}
+
+	if c.Batch != nil {
+		if keyed {
+			v.add(path+".batch", "can't be combined with ordering_key or key_concurrency")
+		}
+		if c.LargeBody != nil {
+			v.add(path+".batch", "can't be combined with large_body")
+		}
+		if c.Batch.Size < 0 {
+			v.add(path+".batch.size", "must not be negative")
+		}
+		if c.Batch.Wait < 0 {
+			v.add(path+".batch.wait", "must not be negative")
+		}
+	}
+
+	// the default exchange routes by queue name, a failed message must not be routed back to its queue
+	if c.DeadLetter != nil && c.DeadLetter.Exchange == "" {
+		switch c.DeadLetter.RoutingKey {
+		case "":
+			v.add(path+".dead_letter.routing_key", "is required without exchange, the original routing key may route the message back to its queue")
+		case c.Queue:
+			v.add(path+".dead_letter.routing_key", "routes the message back to queue %s", c.Queue)
+		}
+	}
+
+	if c.LargeBody != nil && c.LargeBody.Threshold < 0 {
+		v.add(path+".large_body.threshold", "must not be negative")
+	}
+
+	if c.Stream != nil {
+		switch c.Stream.OffsetStore {
+		case "", OffsetStoreFile, OffsetStoreQueue:
+		default:
+			v.add(path+".stream.offset_store", "unknown offset store %s, expected file or queue", c.Stream.OffsetStore)
+		}
+		if c.Stream.FlushInterval < 0 {
+			v.add(path+".stream.flush_interval", "must not be negative")
+		}
+	}
+}
+
+// unusedKeys returns the paths of the config keys which aren't used by the plugin.
+// Keys starting with x- are skipped, they are commonly used for YAML anchors.
+func unusedKeys(raw map[string]any) ([]string, error) {
+	var md mapstructure.Metadata
+	decoder, err := mapstructure.NewDecoder(&mapstructure.DecoderConfig{
+		Result:           new(Config),
+		Metadata:         &md,
+		WeaklyTypedInput: true,
+		DecodeHook: mapstructure.ComposeDecodeHookFunc(
+			mapstructure.StringToTimeDurationHookFunc(),
+			mapstructure.StringToSliceHookFunc(","),
+		),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	err = decoder.Decode(raw)
+	if err != nil {
+		return nil, err
+	}
+
+	unused := make([]string, 0, len(md.Unused))
+	for _, key := range md.Unused {
+		name := key[strings.LastIndex(key, ".")+1:]
+		if strings.HasPrefix(name, "x-") {
+			continue
+		}
+		unused = append(unused, pluginName+"."+key)
+	}
+	sort.Strings(unused)
+
+	return unused, nil
+}
@@ -2,80 +2,222 @@ package thumper
 
 import (
 	"context"
-	"encoding/json"
 	"fmt"
 	"github.com/dstrop/thumper/amqp"
 	"github.com/dstrop/thumper/common"
 	"github.com/roadrunner-server/errors"
 	"github.com/roadrunner-server/goridge/v3/pkg/frame"
 	"github.com/roadrunner-server/pool/payload"
+	"go.opentelemetry.io/otel/trace"
 	"go.uber.org/zap"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
+// publisher publishes messages, replies and dead-lettered copies of messages, it's implemented by amqp.Client
+type publisher interface {
+	Publish(exchange, key string, mandatory, immediate bool, contentType, contentEncoding string, message []byte, headers amqp.Table) error
+	Republish(exchange, key string, delivery *amqp.Delivery, headers amqp.Table) error
+	Reply(delivery *amqp.Delivery, body []byte, headers amqp.Table) error
+}
+
 type Worker struct {
-	log  *zap.Logger
-	pool common.Pool
+	log     *zap.Logger
+	pool    common.Pool
+	client  publisher
+	metrics *metrics
 
 	wwg sync.WaitGroup
 	wg  sync.WaitGroup
 
-	messageCh chan *message
+	// ctx is cancelled to abort in-flight executions, execMu is held (read) for the duration of each one
+	ctx    context.Context
+	cancel context.CancelFunc
+	execMu sync.RWMutex
+	// stopping requeues messages not executed yet
+	stopping atomic.Bool
+	// bodies holds large bodies read by the workers over RPC
+	bodies *bodyStore
+
+	sched *scheduler
 }
 
-func NewWorkerPool(pool common.Pool, workerCount int, logger *zap.Logger) *Worker {
+func NewWorkerPool(ctx context.Context, pool common.Pool, client *amqp.Client, workerCount int, metrics *metrics, logger *zap.Logger) *Worker {
 	w := &Worker{
-		pool:      pool,
-		messageCh: make(chan *message),
-		log:       logger,
+		pool:    pool,
+		client:  client,
+		metrics: metrics,
+		sched:   newScheduler(),
+		log:     logger,
 	}
+	w.ctx, w.cancel = context.WithCancel(ctx)
 
+	w.wwg.Add(workerCount)
 	for i := 0; i < workerCount; i++ {
-		go w.worker(w.messageCh)
+		go w.worker()
 	}
 
 	return w
 }
 
-func (w *Worker) Consume(deliveries <-chan amqp.Delivery, consumer *ConsumerConfig) {
-	if consumer.Concurrency > 0 {
-		go w.concurrencyConsumer(deliveries, consumer)
+func (w *Worker) Consume(c *consumer) {
+	limiters := make([]*keyLimiter, len(c.keyLimits))
+	for i, limit := range c.keyLimits {
+		limiters[i] = newKeyLimiter(limit)
+	}
+
+	// prefetched messages are buffered, so messages of other keys can pass the held ones
+	capacity := 0
+	if len(limiters) > 0 {
+		capacity = c.cfg.Prefetch
+	}
+
+	l := w.sched.addLane(c.cfg.Weight, c.cfg.MaxInFlight, capacity, limiters...)
+	c.held = func() int {
+		return w.sched.held(l)
+	}
+
+	w.wg.Add(1)
+	if c.cfg.Batch != nil {
+		go w.batchConsumer(c, l)
+	} else if c.cfg.Concurrency > 0 {
+		go w.concurrencyConsumer(c, l)
 	} else {
-		go w.consumer(deliveries, consumer)
+		go w.consumer(c, l)
 	}
 }
 
+// StopFeeding requeues messages not executed yet instead of executing them
+func (w *Worker) StopFeeding() {
+	w.stopping.Store(true)
+}
+
+// Cancel aborts in-flight executions and waits until their messages are requeued.
+// Messages dispatched afterward are requeued right away.
+func (w *Worker) Cancel() {
+	w.cancel()
+
+	w.execMu.Lock()
+	defer w.execMu.Unlock()
+}
+
+// Reset pauses dispatching, waits for in-flight executions and resets the pool.
+// Consumers keep their broker subscriptions, deliveries wait for the pool meanwhile.
+func (w *Worker) Reset(ctx context.Context) error {
+	w.sched.pause()
+	defer w.sched.resume()
+
+	w.execMu.Lock()
+	defer w.execMu.Unlock()
+
+	return w.pool.Reset(ctx)
+}
+
+// RollingReset replaces the workers one by one, a new worker is added before an old one is removed.
+// The pool removes free workers, so a new one may be removed instead, the replacement is retried until no old worker is left.
+// When it gives up, the pool keeps running with both old and new workers, the error tells how many old ones are left.
+func (w *Worker) RollingReset(ctx context.Context) error {
+	old := make(map[int64]struct{})
+	for _, process := range w.pool.Workers() {
+		old[process.Pid()] = struct{}{}
+	}
+
+	remaining := func() int {
+		n := 0
+		for _, process := range w.pool.Workers() {
+			if _, ok := old[process.Pid()]; ok {
+				n++
+			}
+		}
+		return n
+	}
+
+	for attempts := 3 * len(old); attempts > 0; attempts-- {
+		if remaining() == 0 {
+			return nil
+		}
+
+		err := w.pool.AddWorker()
+		if err != nil {
+			return partialResetError(remaining(), len(old), fmt.Errorf("failed to add worker: %w", err))
+		}
+
+		err = w.pool.RemoveWorker(ctx)
+		if err != nil {
+			return partialResetError(remaining(), len(old), fmt.Errorf("failed to remove worker, the pool has an extra worker: %w", err))
+		}
+	}
+
+	if left := remaining(); left > 0 {
+		return partialResetError(left, len(old), errors.Str("workers were not replaced, the pool may be in debug mode"))
+	}
+
+	return nil
+}
+
+func partialResetError(remaining, total int, err error) error {
+	return fmt.Errorf("rolling reset stopped with %d of %d old workers left, the pool runs old and new workers: %w", remaining, total, err)
+}
+
 func (w *Worker) WaitClose() {
 	w.wg.Wait()
-	close(w.messageCh)
+	w.sched.close()
 	w.wwg.Wait()
 }
 
-func (w *Worker) consumer(deliveries <-chan amqp.Delivery, consumer *ConsumerConfig) {
-	w.wg.Add(1)
+func (w *Worker) consumer(c *consumer, l *lane) {
 	defer w.wg.Done()
+	defer w.sched.closeLane(l)
 
-	for delivery := range deliveries {
-		w.messageCh <- &message{
-			delivery: &delivery,
-			consumer: consumer,
-		}
+	for delivery := range c.amqp.Deliveries() {
+		w.dispatch(l, c.message(&delivery), nil)
 	}
 }
 
-func (w *Worker) concurrencyConsumer(deliveries <-chan amqp.Delivery, consumer *ConsumerConfig) {
-	w.wg.Add(1)
+func (w *Worker) concurrencyConsumer(c *consumer, l *lane) {
 	defer w.wg.Done()
+	defer w.sched.closeLane(l)
+
+	semaphore := make(chan struct{}, c.cfg.Concurrency)
+
+	for delivery := range c.amqp.Deliveries() {
+		w.dispatch(l, c.message(&delivery), semaphore)
+	}
+}
 
-	semaphore := make(chan struct{}, consumer.Concurrency)
+// dispatch queues the message for the workers, once stopping it's requeued right away
+func (w *Worker) dispatch(l *lane, msg *message, semaphore chan struct{}) {
+	if msg.batch != nil {
+		w.metrics.delivered(msg.consumer.Queue, len(msg.batch.messages))
+	} else {
+		w.metrics.delivered(msg.consumer.Queue, 1)
+	}
+
+	if w.stopping.Load() {
+		w.release(msg)
+		return
+	}
 
-	for delivery := range deliveries {
+	if semaphore != nil {
 		semaphore <- struct{}{}
+		msg.semaphore = semaphore
+	}
+	w.sched.push(l, msg)
+}
+
+// release requeues a message that wasn't dispatched
+func (w *Worker) release(msg *message) {
+	messages := []*message{msg}
+	if msg.batch != nil {
+		messages = msg.batch.messages
+		msg.batch.tracker.done(msg.batch.id)
+	}
 
-		w.messageCh <- &message{
-			delivery:  &delivery,
-			consumer:  consumer,
-			semaphore: semaphore,
+	for _, m := range messages {
+		w.requeue(m)
+		if m.finished != nil {
+			m.finished()
 		}
 	}
 }
@@ -89,20 +231,57 @@ const (
 type message struct {
 	delivery *amqp.Delivery
 	consumer *ConsumerConfig
+	// body is the delivery body, decompressed when the consumer decompresses bodies
+	body []byte
+	// bodyID is set instead of body for large bodies, the worker reads them from the body store
+	bodyID   string
+	bodySize int
+
+	span trace.Span
+	// batched is set when span is the span of the batch of the message
+	batched bool
+	// trace is the trace context passed to the worker
+	trace map[string]string
 
 	semaphore chan struct{}
+	// processed is called once the message is settled, unless it's requeued
+	processed func()
+	requeued  bool
+	// finished is called when the worker is done with the message, even when it couldn't be settled
+	finished func()
+
+	// batch is set for a group of messages processed at once
+	batch *batch
+
+	lane *lane
+	// keys are the keys of the lane limiters, empty when the message has none
+	keys []string
 }
 
-func (w *Worker) worker(messageCh <-chan *message) {
-	w.wwg.Add(1)
+func (w *Worker) worker() {
 	defer w.wwg.Done()
 
-	for msg := range messageCh {
+	for {
+		msg, ok := w.sched.pop()
+		if !ok {
+			return
+		}
+
 		w.doWork(msg)
+		w.sched.done(msg)
 	}
 }
 
 func (w *Worker) doWork(msg *message) {
+	if msg.batch != nil {
+		w.doBatch(msg)
+		return
+	}
+
+	if msg.finished != nil {
+		defer msg.finished()
+	}
+
 	if msg.semaphore != nil {
 		defer func() {
 			<-msg.semaphore
@@ -115,14 +294,50 @@ func (w *Worker) doWork(msg *message) {
 		return
 	}
 
-	pld, err := createPayload(msg.delivery, msg.consumer)
+	defer msg.settled()
+
+	ctx, span := startProcessSpan(msg.delivery, msg.consumer.Queue)
+	defer span.End()
+	msg.span, msg.trace = span, traceContext(ctx)
+
+	w.execMu.RLock()
+	defer w.execMu.RUnlock()
+
+	if w.ctx.Err() != nil || w.stopping.Load() {
+		w.requeue(msg)
+		return
+	}
+
+	err := w.decodeBody(msg)
+	if err != nil {
+		w.workFailed(msg, "failed to decompress body", err)
+		return
+	}
+
+	release := w.bodies.hold(msg)
+	defer release()
+
+	pld, err := createPayload(msg)
 	if err != nil {
 		w.workFailed(msg, "failed to create payload", err)
 		return
 	}
 
-	result, err := w.exec(pld)
+	reply := &replyStream{client: w.client, delivery: msg.delivery}
+
+	start := time.Now()
+	result, err := w.exec(pld, msg.consumer.ExecTimeout, reply.write)
+	w.metrics.executed(msg.consumer.Queue, time.Since(start))
 	if err != nil {
+		if errors.Is(errors.Stop, err) {
+			w.log.Warn("execution cancelled", zap.Error(err))
+			w.requeue(msg)
+			return
+		}
+		if errors.Is(errors.ExecTTL, err) {
+			w.workFailed(msg, "execution timeout", err)
+			return
+		}
 		w.workFailed(msg, "failed to execute payload", err)
 		return
 	}
@@ -132,6 +347,22 @@ func (w *Worker) doWork(msg *message) {
 		return
 	}
 
+	if reply.discarded {
+		w.log.Warn("streamed response discarded, the message has no reply_to", zap.String("queue", msg.consumer.Queue))
+	}
+	err = reply.close()
+	if err != nil {
+		w.workFailed(msg, "failed to publish reply", err)
+		return
+	}
+
+	// the broker considers auto-acked messages settled once delivered
+	if msg.consumer.AutoAck {
+		spanSettled(msg, outcomeAutoAck)
+		return
+	}
+
+	spanSettled(msg, resultOutcome(result.Body[0]))
 	switch result.Body[0] {
 	case Ack:
 		err = msg.delivery.Ack(false)
@@ -143,60 +374,215 @@ func (w *Worker) doWork(msg *message) {
 
 	if err != nil {
 		w.log.Error("failed to ack message", zap.Error(err))
+		spanFailed(msg.span, "failed to ack message", err)
+		return
 	}
+	w.metrics.settled(msg.consumer.Queue, result.Body[0], 1)
+}
+
+func (m *message) settled() {
+	if m.processed != nil && !m.requeued {
+		m.processed()
+	}
+}
+
+// requeue returns the message to the queue, it's not handled as failed
+func (w *Worker) requeue(msg *message) {
+	msg.requeued = true
+
+	if msg.consumer.AutoAck {
+		spanSettled(msg, outcomeAutoAck)
+		return
+	}
+
+	spanSettled(msg, outcomeRequeue)
+	err := msg.delivery.Nack(false, true)
+	if err != nil {
+		w.log.Error("failed to requeue message", zap.Error(err))
+		spanFailed(msg.span, "failed to requeue message", err)
+		return
+	}
+	w.metrics.settled(msg.consumer.Queue, Nack, 1)
 }
 
 func (w *Worker) workFailed(msg *message, logMsg string, err error) {
 	w.log.Error(logMsg, zap.Error(err))
+	spanFailed(msg.span, logMsg, err)
+	w.fail(msg, logMsg, err)
+}
 
+// fail dead-letters or nacks the failed message
+func (w *Worker) fail(msg *message, logMsg string, err error) {
+	if msg.consumer.DeadLetter != nil {
+		dlErr := w.deadLetter(msg, logMsg, err)
+		if dlErr == nil {
+			return
+		}
+		w.log.Error("failed to dead-letter message", zap.Error(dlErr))
+	}
+
+	if msg.consumer.AutoAck {
+		spanSettled(msg, outcomeAutoAck)
+		return
+	}
+
+	if *msg.consumer.RequeueOnFail {
+		spanSettled(msg, outcomeRequeue)
+	} else {
+		spanSettled(msg, outcomeReject)
+	}
 	err = msg.delivery.Nack(false, *msg.consumer.RequeueOnFail)
 	if err != nil {
 		w.log.Error("failed to nack message", zap.Error(err))
+		spanFailed(msg.span, "failed to nack message", err)
+		return
 	}
+	w.metrics.settled(msg.consumer.Queue, Nack, 1)
 }
 
-func createPayload(delivery *amqp.Delivery, consumer *ConsumerConfig) (*payload.Payload, error) {
-	pld := &payload.Payload{
-		Body: delivery.Body,
-		// TODO: add support for other codecs
-		Codec: frame.CodecJSON,
+// deadLetter republishes the message with failure diagnostics and acks the original
+func (w *Worker) deadLetter(msg *message, reason string, cause error) error {
+	key := msg.consumer.DeadLetter.RoutingKey
+	if key == "" {
+		key = msg.delivery.RoutingKey
 	}
-	msgContext := map[string]interface{}{
-		"queue":       consumer.Queue,
-		"headers":     delivery.Headers,
-		"exchange":    delivery.Exchange,
-		"routingKey":  delivery.RoutingKey,
-		"deliveryTag": delivery.DeliveryTag,
+
+	headers := amqp.Table{
+		"x-thumper-error":       cause.Error(),
+		"x-thumper-reason":      reason,
+		"x-thumper-consumer":    msg.delivery.ConsumerTag,
+		"x-thumper-queue":       msg.consumer.Queue,
+		"x-thumper-exchange":    msg.delivery.Exchange,
+		"x-thumper-routing-key": msg.delivery.RoutingKey,
+		"x-thumper-failed-at":   time.Now().UTC(),
 	}
 
-	var err error
-	pld.Context, err = json.Marshal(msgContext)
+	err := w.client.Republish(msg.consumer.DeadLetter.Exchange, key, msg.delivery, headers)
 	if err != nil {
-		return nil, fmt.Errorf("failed to marshal message headers: %w", err)
+		return err
 	}
+	spanSettled(msg, outcomeDeadLetter)
 
-	return pld, nil
+	if msg.consumer.AutoAck {
+		return nil
+	}
+
+	err = msg.delivery.Ack(false)
+	if err != nil {
+		// the message is already dead-lettered, nacking it now would only duplicate it
+		w.log.Error("failed to ack dead-lettered message", zap.Error(err))
+		spanFailed(msg.span, "failed to ack dead-lettered message", err)
+		return nil
+	}
+	w.metrics.settled(msg.consumer.Queue, Ack, 1)
+
+	return nil
+}
+
+// decodeBody sets the message body, decompressing it when enabled
+func (w *Worker) decodeBody(msg *message) error {
+	if !msg.consumer.Decompress || msg.delivery.ContentEncoding == "" {
+		msg.body = msg.delivery.Body
+		return nil
+	}
+
+	var err error
+	msg.body, err = decompress(msg.delivery.ContentEncoding, msg.delivery.Body, msg.consumer.MaxDecompressedSize)
+	return err
 }
 
-func (w *Worker) exec(pld *payload.Payload) (*payload.Payload, error) {
-	resultCh, err := w.pool.Exec(context.Background(), pld, nil)
+func createPayload(msg *message) (*payload.Payload, error) {
+	delivery, consumer := msg.delivery, msg.consumer
+
+	codec, err := contextCodec(consumer.Codec)
 	if err != nil {
 		return nil, err
 	}
 
-	// TODO: add timeout and kill worker if it's not responding
-	select {
-	case result := <-resultCh:
-		if result.Error() != nil {
-			return nil, result.Error()
-		}
+	pld := &payload.Payload{
+		Body:  msg.body,
+		Codec: codec,
+	}
+
+	pld.Context, err = encodeContext(consumer.Codec, &MessageContext{
+		Version:     ContextVersion,
+		Queue:       consumer.Queue,
+		Headers:     delivery.Headers,
+		Exchange:    delivery.Exchange,
+		RoutingKey:  delivery.RoutingKey,
+		DeliveryTag: delivery.DeliveryTag,
+		BodyID:      msg.bodyID,
+		BodySize:    msg.bodySize,
+		Trace:       msg.trace,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal message headers: %w", err)
+	}
+
+	return pld, nil
+}
 
-		if result.Payload().Flags&frame.STREAM != 0 {
-			return nil, errors.Str("streaming is not supported")
+// exec executes the payload and waits for the result,
+// the pool kills the worker when the timeout is reached or the worker is cancelled.
+// Streamed response frames are passed to stream as they arrive, the last frame is the result.
+// Without stream, or when it fails, the worker is asked to stop streaming.
+func (w *Worker) exec(pld *payload.Payload, timeout time.Duration, stream func(chunk []byte) error) (*payload.Payload, error) {
+	ctx := w.ctx
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	stopCh := make(chan struct{})
+	resultCh, err := w.pool.Exec(ctx, pld, stopCh)
+	if err != nil {
+		close(stopCh)
+		return nil, w.execError(err)
+	}
+	defer func() {
+		close(stopCh)
+		// the pool releases the worker once the stream is cancelled and its frames are consumed
+		go func() {
+			for range resultCh {
+			}
+		}()
+	}()
+
+	for {
+		select {
+		case result, ok := <-resultCh:
+			if !ok {
+				return nil, errors.Str("worker empty response")
+			}
+
+			if result.Error() != nil {
+				return nil, w.execError(result.Error())
+			}
+
+			if result.Payload().Flags&frame.STREAM != 0 {
+				if stream == nil {
+					return nil, errors.Str("streamed responses are not supported")
+				}
+				err = stream(result.Payload().Body)
+				if err != nil {
+					return nil, err
+				}
+				continue
+			}
+
+			return result.Payload(), nil
+		case <-ctx.Done():
+			return nil, w.execError(errors.E(errors.ExecTTL, ctx.Err()))
 		}
+	}
+}
 
-		return result.Payload(), nil
-	default:
-		return nil, errors.Str("worker empty response")
+// execError marks errors of executions cancelled on stop with the Stop kind, so they aren't reported as timeouts
+func (w *Worker) execError(err error) error {
+	if w.ctx.Err() != nil {
+		return errors.E(errors.Stop, err)
 	}
+
+	return err
 }
@@ -0,0 +1,292 @@
+package thumper
+
+import (
+	"context"
+	"errors"
+	"github.com/dstrop/thumper/amqp"
+	"github.com/dstrop/thumper/common"
+	amqp091 "github.com/rabbitmq/amqp091-go"
+	"github.com/roadrunner-server/pool/fsm"
+	"github.com/roadrunner-server/pool/payload"
+	staticPool "github.com/roadrunner-server/pool/pool/static_pool"
+	"github.com/roadrunner-server/pool/worker"
+	"go.uber.org/zap"
+	"os/exec"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testPool runs every execution until it's cancelled, like a worker that never responds
+type testPool struct {
+	common.Pool
+
+	mu       sync.Mutex
+	payloads []*payload.Payload
+	workers  []*worker.Process
+}
+
+// testPoolWorkers returns a pool with workers in the states, the processes aren't started
+func testPoolWorkers(t *testing.T, states ...int64) *testPool {
+	p := &testPool{}
+	for _, state := range states {
+		process, err := worker.InitBaseWorker(exec.Command("php"), worker.WithLog(zap.NewNop()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		// working workers are ready first
+		if state == fsm.StateWorking {
+			process.State().Transition(fsm.StateReady)
+		}
+		process.State().Transition(state)
+		p.workers = append(p.workers, process)
+	}
+
+	return p
+}
+
+func (p *testPool) Workers() []*worker.Process {
+	return p.workers
+}
+
+func (p *testPool) Exec(_ context.Context, pld *payload.Payload, stopCh chan struct{}) (chan *staticPool.PExec, error) {
+	p.mu.Lock()
+	p.payloads = append(p.payloads, pld)
+	p.mu.Unlock()
+
+	resultCh := make(chan *staticPool.PExec)
+	go func() {
+		<-stopCh
+		close(resultCh)
+	}()
+
+	return resultCh, nil
+}
+
+func testWorker(client publisher) *Worker {
+	w := &Worker{log: zap.NewNop(), pool: &testPool{}, client: client, bodies: newBodyStore()}
+	w.ctx, w.cancel = context.WithCancel(context.Background())
+
+	return w
+}
+
+type publishedMessage struct {
+	exchange, key string
+	headers       amqp.Table
+}
+
+// testPublisher records the published messages
+type testPublisher struct {
+	err         error
+	published   []publishedMessage
+	republished []publishedMessage
+}
+
+func (p *testPublisher) Publish(exchange, key string, _, _ bool, _, _ string, _ []byte, headers amqp.Table) error {
+	if p.err != nil {
+		return p.err
+	}
+	p.published = append(p.published, publishedMessage{exchange: exchange, key: key, headers: headers})
+	return nil
+}
+
+func (p *testPublisher) Republish(exchange, key string, _ *amqp.Delivery, headers amqp.Table) error {
+	if p.err != nil {
+		return p.err
+	}
+	p.republished = append(p.republished, publishedMessage{exchange: exchange, key: key, headers: headers})
+	return nil
+}
+
+func (p *testPublisher) Reply(*amqp.Delivery, []byte, amqp.Table) error {
+	return p.err
+}
+
+// testAcknowledger records how the delivery was settled
+type testAcknowledger struct {
+	settled []string
+}
+
+func (a *testAcknowledger) Ack(uint64, bool) error {
+	a.settled = append(a.settled, "ack")
+	return nil
+}
+
+func (a *testAcknowledger) Nack(_ uint64, _ bool, requeue bool) error {
+	if requeue {
+		a.settled = append(a.settled, "requeue")
+	} else {
+		a.settled = append(a.settled, "nack")
+	}
+	return nil
+}
+
+func (a *testAcknowledger) Reject(uint64, bool) error {
+	a.settled = append(a.settled, "reject")
+	return nil
+}
+
+func (a *testAcknowledger) IsClosed() bool {
+	return false
+}
+
+func TestFailDeadLetter(t *testing.T) {
+	tests := []struct {
+		name       string
+		deadLetter *DeadLetterConfig
+		autoAck    bool
+		publishErr error
+		exchange   string
+		key        string
+		settled    []string
+	}{
+		{
+			name:       "routing key",
+			deadLetter: &DeadLetterConfig{Exchange: "orders.dlx", RoutingKey: "orders.failed"},
+			exchange:   "orders.dlx",
+			key:        "orders.failed",
+			settled:    []string{"ack"},
+		},
+		{
+			name:       "original routing key",
+			deadLetter: &DeadLetterConfig{Exchange: "orders.dlx"},
+			exchange:   "orders.dlx",
+			key:        "orders.created",
+			settled:    []string{"ack"},
+		},
+		{
+			name:       "default exchange",
+			deadLetter: &DeadLetterConfig{RoutingKey: "orders.failed"},
+			key:        "orders.failed",
+			settled:    []string{"ack"},
+		},
+		{
+			name:       "auto ack",
+			deadLetter: &DeadLetterConfig{Exchange: "orders.dlx"},
+			autoAck:    true,
+			exchange:   "orders.dlx",
+			key:        "orders.created",
+		},
+		{
+			name:       "republish failed",
+			deadLetter: &DeadLetterConfig{Exchange: "orders.dlx"},
+			publishErr: errors.New("channel closed"),
+			settled:    []string{"requeue"},
+		},
+		{
+			name:    "without dead letter",
+			settled: []string{"requeue"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := &testPublisher{err: tt.publishErr}
+			w := testWorker(client)
+
+			acknowledger := &testAcknowledger{}
+			cfg := &ConsumerConfig{Queue: "orders", AutoAck: tt.autoAck, DeadLetter: tt.deadLetter}
+			cfg.InitDefaults()
+			msg := &message{
+				consumer: cfg,
+				delivery: &amqp.Delivery{Delivery: amqp091.Delivery{
+					Acknowledger: acknowledger,
+					ConsumerTag:  "orders-1",
+					Exchange:     "orders",
+					RoutingKey:   "orders.created",
+				}},
+			}
+
+			before := time.Now().UTC()
+			w.fail(msg, "failed to execute payload", errors.New("worker crashed"))
+
+			if !slices.Equal(acknowledger.settled, tt.settled) {
+				t.Errorf("settled %v, expected %v", acknowledger.settled, tt.settled)
+			}
+
+			if tt.deadLetter == nil || tt.publishErr != nil {
+				if len(client.republished) != 0 {
+					t.Errorf("republished %d messages", len(client.republished))
+				}
+				return
+			}
+
+			if len(client.republished) != 1 {
+				t.Fatalf("republished %d messages, expected 1", len(client.republished))
+			}
+			copied := client.republished[0]
+			if copied.exchange != tt.exchange || copied.key != tt.key {
+				t.Errorf("republished to %q with key %q, expected %q with %q", copied.exchange, copied.key, tt.exchange, tt.key)
+			}
+
+			expected := amqp.Table{
+				"x-thumper-error":       "worker crashed",
+				"x-thumper-reason":      "failed to execute payload",
+				"x-thumper-consumer":    "orders-1",
+				"x-thumper-queue":       "orders",
+				"x-thumper-exchange":    "orders",
+				"x-thumper-routing-key": "orders.created",
+			}
+			for key, value := range expected {
+				if copied.headers[key] != value {
+					t.Errorf("header %s %v, expected %v", key, copied.headers[key], value)
+				}
+			}
+			failedAt, ok := copied.headers["x-thumper-failed-at"].(time.Time)
+			if !ok || failedAt.Before(before) || failedAt.Location() != time.UTC {
+				t.Errorf("header x-thumper-failed-at %v, expected the failure time in UTC", copied.headers["x-thumper-failed-at"])
+			}
+		})
+	}
+}
+
+func TestExecTimeout(t *testing.T) {
+	w := testWorker(&testPublisher{})
+
+	work := func(timeout time.Duration) (*testAcknowledger, chan struct{}) {
+		requeueOnFail := false
+		acknowledger := &testAcknowledger{}
+		msg := &message{
+			consumer: &ConsumerConfig{Queue: "orders", RequeueOnFail: &requeueOnFail, ExecTimeout: timeout},
+			delivery: &amqp.Delivery{Delivery: amqp091.Delivery{Acknowledger: acknowledger, Body: []byte("{}")}},
+		}
+
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			w.doWork(msg)
+		}()
+
+		return acknowledger, done
+	}
+
+	timedOut, timedOutDone := work(50 * time.Millisecond)
+	unlimited, unlimitedDone := work(0)
+
+	select {
+	case <-timedOutDone:
+	case <-time.After(time.Second):
+		t.Fatal("the execution with exec_timeout wasn't interrupted")
+	}
+	if !slices.Equal(timedOut.settled, []string{"nack"}) {
+		t.Errorf("timed out message settled %v, expected it to fail", timedOut.settled)
+	}
+
+	select {
+	case <-unlimitedDone:
+		t.Fatal("the execution without exec_timeout was interrupted by the timeout of another consumer")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// stop interrupts the executions without a timeout and requeues their messages
+	w.Cancel()
+	select {
+	case <-unlimitedDone:
+	case <-time.After(time.Second):
+		t.Fatal("the execution without exec_timeout wasn't interrupted on stop")
+	}
+	if !slices.Equal(unlimited.settled, []string{"requeue"}) {
+		t.Errorf("cancelled message settled %v, expected it to be requeued", unlimited.settled)
+	}
+}